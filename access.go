@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/imkira/gcp-iap-auth/jwt"
+)
+
+// errAccessDenied is wrapped by the errors of authorizers denying access.
+var errAccessDenied = errors.New("access denied")
+
+// authorizer decides whether a request with a verified token is allowed.
+type authorizer interface {
+	// authorize returns why the request is allowed, or an error wrapping
+	// errAccessDenied telling why it is not.
+	authorize(req *http.Request, claims *jwt.Claims) (decision, error)
+}
+
+// decision tells why an authorizer allows a request.
+type decision struct {
+	reason string
+	// header holds headers to set on the request passed to the backend, or
+	// on the response of /auth.
+	header http.Header
+}
+
+// access holds the checks done on requests once their token is verified.
+type access struct {
+	identity     identityMode
+	authorizers  []authorizer
+	groups       *groupDirectory
+	groupsHeader string
+	// decisionHeaders are the headers authorizers may set.
+	decisionHeaders []string
+	// routed tells whether some authorizer depends on the route of requests,
+	// which /auth must then be told in the original headers.
+	routed   bool
+	original originalHeaders
+}
+
+func newAccess(opts *Options) (*access, error) {
+	a := &access{
+		identity:     identityMode(opts.IdentityHeaders),
+		groupsHeader: opts.GroupsHeader,
+		original: originalHeaders{
+			uri:    opts.OrigURIHeader,
+			host:   opts.OrigHostHeader,
+			method: opts.OrigMethodHeader,
+		},
+	}
+	if opts.GroupsFile != "" {
+		groups, err := loadGroupDirectory(opts.GroupsFile, opts.GroupsReload)
+		if err != nil {
+			return nil, err
+		}
+		a.groups = groups
+	}
+	allowlist, err := newAllowlist(opts)
+	if err != nil {
+		return nil, err
+	}
+	if allowlist != nil {
+		a.authorizers = append(a.authorizers, allowlist)
+	}
+	if opts.AccessRules != "" {
+		rules, err := loadAccessRules(opts.AccessRules)
+		if err != nil {
+			return nil, err
+		}
+		a.authorizers = append(a.authorizers, rules)
+		a.routed = true
+	}
+	if len(opts.Policies) != 0 {
+		ps, err := compilePolicies(opts.Policies)
+		if err != nil {
+			return nil, err
+		}
+		a.authorizers = append(a.authorizers, ps)
+		a.routed = true
+	}
+	if len(opts.AccessLevels) != 0 {
+		reqs, err := parseAccessLevelRequirements(opts.AccessLevels)
+		if err != nil {
+			return nil, err
+		}
+		a.authorizers = append(a.authorizers, reqs)
+		a.routed = true
+	}
+	if opts.WebhookURL != "" {
+		w, err := newWebhook(opts)
+		if err != nil {
+			return nil, err
+		}
+		a.authorizers = append(a.authorizers, w)
+		a.decisionHeaders = append(a.decisionHeaders, w.headers...)
+		a.routed = true
+	}
+	return a, nil
+}
+
+// check checks the identity headers of requests authenticated with IAP
+// tokens, then asks every authorizer whether the request is allowed. It
+// returns the headers the authorizers asked to set, if any.
+func (a *access) check(req *http.Request, claims *jwt.Claims) (http.Header, error) {
+	if a.identity == identityVerify && iapToken(claims) {
+		if err := checkIdentityHeaders(req.Header, claims); err != nil {
+			return nil, err
+		}
+	}
+	if len(a.authorizers) == 0 {
+		return nil, nil
+	}
+	req = req.WithContext(newGroupsContext(req.Context(), a.groups.Groups(claims.Email)))
+	reasons := make([]string, 0, len(a.authorizers))
+	header := http.Header{}
+	for _, authz := range a.authorizers {
+		d, err := authz.authorize(req, claims)
+		if err != nil {
+			return nil, err
+		}
+		reasons = append(reasons, d.reason)
+		for name, values := range d.header {
+			header[name] = values
+		}
+	}
+	log.Printf("Allowed %q (%s)\n", claims.Email, strings.Join(reasons, ", "))
+	return header, nil
+}
+
+// originalRequest returns the request /auth is asked to authorize. When some
+// authorizer depends on its route, the original headers must be set.
+func (a *access) originalRequest(req *http.Request) (*http.Request, error) {
+	if !a.routed {
+		return req, nil
+	}
+	return originalRequest(req, a.original)
+}
+
+// setIdentityHeaders sets the identity headers from the claims of IAP tokens
+// when rewriting them. Identity headers sent along with other tokens cannot
+// come from IAP, so they are removed unless identity headers are ignored.
+func (a *access) setIdentityHeaders(header http.Header, claims *jwt.Claims) {
+	switch {
+	case a.identity == identityIgnore:
+	case !iapToken(claims):
+		removeIdentityHeaders(header)
+	case a.identity == identityRewrite:
+		setIdentityHeaders(header, claims)
+	}
+}
+
+// setDecisionHeaders sets the headers the authorizers asked to set, once
+// every header they may set is removed so that clients cannot forge them.
+func (a *access) setDecisionHeaders(header, decided http.Header) {
+	for _, name := range a.decisionHeaders {
+		header.Del(name)
+	}
+	for name, values := range decided {
+		header[name] = values
+	}
+}
+
+// setGroupsHeader sets the groups header, if any, to the comma-separated
+// groups of the user.
+func (a *access) setGroupsHeader(header http.Header, claims *jwt.Claims) {
+	if a.groupsHeader == "" {
+		return
+	}
+	header.Del(a.groupsHeader)
+	if groups := a.groups.Groups(claims.Email); len(groups) != 0 {
+		header.Set(a.groupsHeader, strings.Join(groups, ","))
+	}
+}
+
+// Close releases the resources used by the checks.
+func (a *access) Close() error {
+	return a.groups.Close()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/imkira/gcp-iap-auth/jwt"
+)
+
+// accessLevelRequirement requires the given access level for requests whose
+// path matches.
+type accessLevelRequirement struct {
+	pattern string
+	path    *regexp.Regexp
+	level   string
+}
+
+// accessLevelRequirements are all checked, so that requests must have the
+// access levels of every requirement matching them.
+type accessLevelRequirements []*accessLevelRequirement
+
+// accessLevelError tells which access level a request lacks.
+type accessLevelError struct {
+	level   string
+	pattern string
+}
+
+func (e *accessLevelError) Error() string {
+	return fmt.Sprintf("%v: missing access level %q required for %s", errAccessDenied, e.level, e.pattern)
+}
+
+func (e *accessLevelError) Unwrap() error {
+	return errAccessDenied
+}
+
+// parseAccessLevelRequirements parses requirements given as "PATH=LEVEL",
+// where PATH is a path prefix or glob like in access rules.
+func parseAccessLevelRequirements(specs []string) (accessLevelRequirements, error) {
+	var reqs accessLevelRequirements
+	for _, spec := range specs {
+		p, level, ok := strings.Cut(spec, "=")
+		if !ok || !strings.HasPrefix(p, "/") || level == "" {
+			return nil, fmt.Errorf("Invalid access level requirement %q (must be PATH=LEVEL)", spec)
+		}
+		reqs = append(reqs, &accessLevelRequirement{
+			pattern: p,
+			path:    compilePathPattern(p),
+			level:   level,
+		})
+	}
+	return reqs, nil
+}
+
+func (reqs accessLevelRequirements) authorize(req *http.Request, claims *jwt.Claims) (decision, error) {
+	p := requestPath(req)
+	levels := claims.AccessLevels()
+	var checked []string
+	for _, r := range reqs {
+		if !r.path.MatchString(p) {
+			continue
+		}
+		if !contains(levels, r.level) {
+			return decision{}, &accessLevelError{level: r.level, pattern: r.pattern}
+		}
+		checked = append(checked, r.level)
+	}
+	if len(checked) == 0 {
+		return decision{reason: "no access level is required"}, nil
+	}
+	return decision{reason: fmt.Sprintf("has access levels %q", checked)}, nil
+}
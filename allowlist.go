@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/imkira/gcp-iap-auth/jwt"
+)
+
+// allowlist allows users by email address, domain or email pattern.
+type allowlist struct {
+	emails   map[string]bool
+	domains  map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// newAllowlist creates the allowlist given by opts, or returns nil if there
+// is none.
+func newAllowlist(opts *Options) (*allowlist, error) {
+	emails, err := loadList(opts.AllowEmails, opts.AllowEmailsFile)
+	if err != nil {
+		return nil, err
+	}
+	domains, err := loadList(opts.AllowDomains, opts.AllowDomainsFile)
+	if err != nil {
+		return nil, err
+	}
+	patterns, err := loadList(opts.AllowPatterns, opts.AllowPatternsFile)
+	if err != nil {
+		return nil, err
+	}
+	return compileAllowlist(emails, domains, patterns)
+}
+
+// compileAllowlist creates an allowlist from the given email addresses,
+// domains and email patterns, or returns nil if they are all empty.
+func compileAllowlist(emails, domains, patterns []string) (*allowlist, error) {
+	if len(emails) == 0 && len(domains) == 0 && len(patterns) == 0 {
+		return nil, nil
+	}
+	l := &allowlist{
+		emails:  make(map[string]bool, len(emails)),
+		domains: make(map[string]bool, len(domains)),
+	}
+	for _, email := range emails {
+		l.emails[strings.ToLower(email)] = true
+	}
+	for _, domain := range domains {
+		l.domains[strings.ToLower(domain)] = true
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", pattern))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid email pattern %q (%v)", pattern, err)
+		}
+		l.patterns = append(l.patterns, re)
+	}
+	return l, nil
+}
+
+// loadList returns the entries of the comma-separated list values followed
+// by the lines of the file at path, if any. Empty lines and lines starting
+// with "#" are ignored.
+func loadList(values, path string) ([]string, error) {
+	var list []string
+	for _, value := range strings.Split(values, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	if path == "" {
+		return list, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read list %q (%v)", path, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			list = append(list, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read list %q (%v)", path, err)
+	}
+	return list, nil
+}
+
+func (l *allowlist) authorize(req *http.Request, claims *jwt.Claims) (decision, error) {
+	email := strings.ToLower(claims.Email)
+	if email != "" && l.emails[email] {
+		return decision{reason: fmt.Sprintf("email %q is allowed", claims.Email)}, nil
+	}
+	if hd := strings.ToLower(claims.HostedDomain); hd != "" && l.domains[hd] {
+		return decision{reason: fmt.Sprintf("hosted domain %q is allowed", claims.HostedDomain)}, nil
+	}
+	if i := strings.LastIndex(email, "@"); i >= 0 && l.domains[email[i+1:]] {
+		return decision{reason: fmt.Sprintf("email domain %q is allowed", email[i+1:])}, nil
+	}
+	if email != "" {
+		for _, re := range l.patterns {
+			if re.MatchString(claims.Email) {
+				return decision{reason: fmt.Sprintf("email matches %q", re)}, nil
+			}
+		}
+	}
+	return decision{}, fmt.Errorf("%w: %q is not in the allowlist", errAccessDenied, claims.Email)
+}
@@ -14,16 +14,16 @@ type userIdentity struct {
 	Email   string `json:"email,omitempty"`
 }
 
-func authHandler(cfg *jwt.Config) http.Handler {
-	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		claims, err := jwt.RequestClaims(req, cfg)
+func authHandler(cfg *jwt.Config, acc *access, onError jwt.ErrorHandler) http.Handler {
+	return jwt.Middleware(cfg, onError)(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		claims, _ := jwt.ClaimsFromContext(req.Context())
+		var header http.Header
+		orig, err := acc.originalRequest(req)
+		if err == nil {
+			header, err = acc.check(orig, claims)
+		}
 		if err != nil {
-			if claims == nil || len(claims.Email) == 0 {
-				log.Printf("Failed to authenticate (%v)\n", err)
-			} else {
-				log.Printf("Failed to authenticate %q (%v)\n", claims.Email, err)
-			}
-			res.WriteHeader(http.StatusUnauthorized)
+			onError(res, req, claims, err)
 			return
 		}
 		user := &userIdentity{
@@ -34,10 +34,13 @@ func authHandler(cfg *jwt.Config) http.Handler {
 		log.Printf("Authenticated %q (token expires at %v)\n", user.Email, expiresAt)
 		res.Header().Add("X-Authenticated-Subject", claims.Subject)
 		res.Header().Add("X-Authenticated-Email", claims.Email)
+		acc.setIdentityHeaders(res.Header(), claims)
+		acc.setGroupsHeader(res.Header(), claims)
+		acc.setDecisionHeaders(res.Header(), header)
 
 		res.WriteHeader(http.StatusOK)
 		if err := json.NewEncoder(res).Encode(user); err != nil {
 			log.Printf("Failed to write response: %v", err)
 		}
-	})
+	}))
 }
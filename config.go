@@ -1,27 +1,68 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/imkira/gcp-iap-auth/jwt"
 	"github.com/jessevdk/go-flags"
 )
 
 type Options struct {
-	ListenAddr      string `long:"listen-addr" env:"GCP_IAP_AUTH_LISTEN_ADDR" description:"Listen address"`
-	ListenPort      int    `long:"listen-port" default:"-1" env:"GCP_IAP_AUTH_LISTEN_PORT" description:"Listen port (default: 80 for HTTP or 443 for HTTPS)"`
-	Audiences       string `long:"audiences" env:"GCP_IAP_AUTH_AUDIENCES" description:"Comma-separated list of JWT Audiences"`
-	PublicKeysPath  string `long:"public-keys" env:"GCP_IAP_AUTH_PUBLIC_KEYS" description:"Path to public keys file (optional)"`
-	TlsCertPath     string `long:"tls-cert" env:"GCP_IAP_AUTH_TLS_CERT" description:"Path to TLS server's, intermediate's and CA's PEM certificate (optional)"`
-	TlsKeyPath      string `long:"tls-key" env:"GCP_IAP_AUTH_TLS_KEY" description:"Path to TLS server's PEM key file (optional)"`
-	Backend         string `long:"backend" env:"GCP_IAP_AUTH_BACKEND" description:"Proxy authenticated requests to the specified URL (optional)"`
-	BackendInsecure bool   `long:"backend-insecure" env:"GCP_IAP_AUTH_BACKEND_INSECURE" description:"Skip verification TLS certificate of backend (optional)"`
-	EmailHeader     string `long:"email-header" env:"GCP_IAP_AUTH_EMAIL_HEADER" default:"X-WEBAUTH-USER" description:"In proxy mode, set the authenticated email address in the specified header"`
-	PublicKeysUrl   string `long:"public-keys-url" env:"GCP_IAP_AUTH_PUBLIC_KEYS_URL" default:"https://www.gstatic.com/iap/verify/public_key" description:"URL to fetch public keys from (optional)"`
+	ListenAddr        string        `long:"listen-addr" env:"GCP_IAP_AUTH_LISTEN_ADDR" description:"Listen address"`
+	ListenPort        int           `long:"listen-port" default:"-1" env:"GCP_IAP_AUTH_LISTEN_PORT" description:"Listen port (default: 80 for HTTP or 443 for HTTPS)"`
+	Audiences         string        `long:"audiences" env:"GCP_IAP_AUTH_AUDIENCES" description:"Comma-separated list of JWT Audiences"`
+	PublicKeysPath    string        `long:"public-keys" env:"GCP_IAP_AUTH_PUBLIC_KEYS" description:"Path to public keys file, in Google's PEM map or JWK Set format (optional)"`
+	TlsCertPath       string        `long:"tls-cert" env:"GCP_IAP_AUTH_TLS_CERT" description:"Path to TLS server's, intermediate's and CA's PEM certificate (optional)"`
+	TlsKeyPath        string        `long:"tls-key" env:"GCP_IAP_AUTH_TLS_KEY" description:"Path to TLS server's PEM key file (optional)"`
+	Backend           string        `long:"backend" env:"GCP_IAP_AUTH_BACKEND" description:"Proxy authenticated requests to the specified URL (optional)"`
+	BackendInsecure   bool          `long:"backend-insecure" env:"GCP_IAP_AUTH_BACKEND_INSECURE" description:"Skip verification TLS certificate of backend (optional)"`
+	EmailHeader       string        `long:"email-header" env:"GCP_IAP_AUTH_EMAIL_HEADER" default:"X-WEBAUTH-USER" description:"In proxy mode, set the authenticated email address in the specified header"`
+	PublicKeysUrl     string        `long:"public-keys-url" env:"GCP_IAP_AUTH_PUBLIC_KEYS_URL" default:"https://www.gstatic.com/iap/verify/public_key" description:"URL to fetch public keys from, in Google's PEM map or JWK Set format (optional)"`
+	Leeway            time.Duration `long:"leeway" env:"GCP_IAP_AUTH_LEEWAY" default:"0s" description:"Clock skew tolerated when checking token expiration and issue times (optional)"`
+	PublicKeysCA      string        `long:"public-keys-ca" env:"GCP_IAP_AUTH_PUBLIC_KEYS_CA" description:"Path to a PEM bundle of additional CA certificates to trust when fetching public keys (optional)"`
+	PublicKeysProxy   string        `long:"public-keys-proxy" env:"GCP_IAP_AUTH_PUBLIC_KEYS_PROXY" description:"Proxy URL to use when fetching public keys, instead of the HTTP(S)_PROXY environment variables (optional)"`
+	PublicKeysTimeout time.Duration `long:"public-keys-timeout" env:"GCP_IAP_AUTH_PUBLIC_KEYS_TIMEOUT" default:"10s" description:"Timeout for fetching public keys"`
+	PublicKeysMode    string        `long:"public-keys-mode" env:"GCP_IAP_AUTH_PUBLIC_KEYS_MODE" default:"auto" choice:"auto" choice:"merge" choice:"failover" description:"How to combine --public-keys and --public-keys-url: auto uses the file if given and the URL otherwise, merge uses the keys of both, failover uses the file when the URL fails"`
+	PublicKeysRefresh time.Duration `long:"public-keys-refresh-interval" env:"GCP_IAP_AUTH_PUBLIC_KEYS_REFRESH_INTERVAL" default:"0s" description:"Refresh public keys in the background, following the key URL's caching headers or every given interval when there are none (optional)"`
+	PublicKeysCache   string        `long:"public-keys-cache" env:"GCP_IAP_AUTH_PUBLIC_KEYS_CACHE" description:"Path to a file where fetched public keys are cached, used at startup when the key URL is unreachable (optional)"`
+	PublicKeysGrace   time.Duration `long:"public-keys-grace-period" env:"GCP_IAP_AUTH_PUBLIC_KEYS_GRACE_PERIOD" default:"10m" description:"Keep trusting public keys for this long after they are removed from the key URL or file"`
+	OIDCAudiences     string        `long:"oidc-audiences" env:"GCP_IAP_AUTH_OIDC_AUDIENCES" description:"Comma-separated list of audiences of Google-signed OpenID Connect ID tokens to accept as Authorization bearer tokens, besides IAP tokens (optional)"`
+	OIDCPublicKeysUrl string        `long:"oidc-public-keys-url" env:"GCP_IAP_AUTH_OIDC_PUBLIC_KEYS_URL" default:"https://www.googleapis.com/oauth2/v3/certs" description:"URL to fetch the public keys of Google-signed OpenID Connect ID tokens from"`
+	OIDCKeysCache     string        `long:"oidc-public-keys-cache" env:"GCP_IAP_AUTH_OIDC_PUBLIC_KEYS_CACHE" description:"Path to a file where fetched public keys of Google-signed OpenID Connect ID tokens are cached, used at startup when their URL is unreachable (optional)"`
+	MaxTokenAge       time.Duration `long:"max-token-age" env:"GCP_IAP_AUTH_MAX_TOKEN_AGE" default:"0s" description:"Reject tokens issued longer ago than this, regardless of their expiration (optional)"`
+	IdentityHeaders   string        `long:"identity-headers" env:"GCP_IAP_AUTH_IDENTITY_HEADERS" default:"ignore" choice:"ignore" choice:"verify" choice:"rewrite" description:"What to do with the X-Goog-Authenticated-User-Email and X-Goog-Authenticated-User-Id headers: ignore them, verify they match the token, or rewrite them from the token"`
+	AllowEmails       string        `long:"allow-emails" env:"GCP_IAP_AUTH_ALLOW_EMAILS" description:"Comma-separated list of email addresses of users allowed access (optional)"`
+	AllowEmailsFile   string        `long:"allow-emails-file" env:"GCP_IAP_AUTH_ALLOW_EMAILS_FILE" description:"Path to a file listing email addresses of users allowed access, one per line (optional)"`
+	AllowDomains      string        `long:"allow-domains" env:"GCP_IAP_AUTH_ALLOW_DOMAINS" description:"Comma-separated list of domains whose users are allowed access, matched against the hosted domain and the email domain (optional)"`
+	AllowDomainsFile  string        `long:"allow-domains-file" env:"GCP_IAP_AUTH_ALLOW_DOMAINS_FILE" description:"Path to a file listing domains whose users are allowed access, one per line (optional)"`
+	AllowPatterns     string        `long:"allow-email-patterns" env:"GCP_IAP_AUTH_ALLOW_EMAIL_PATTERNS" description:"Comma-separated list of regular expressions matching the whole email address of users allowed access (optional)"`
+	AllowPatternsFile string        `long:"allow-email-patterns-file" env:"GCP_IAP_AUTH_ALLOW_EMAIL_PATTERNS_FILE" description:"Path to a file listing regular expressions matching the whole email address of users allowed access, one per line (optional)"`
+	AccessRules       string        `long:"access-rules" env:"GCP_IAP_AUTH_ACCESS_RULES" description:"Path to a JSON file with an ordered list of rules allowing or denying requests by host, path, method and user (optional)"`
+	OrigURIHeader     string        `long:"original-uri-header" env:"GCP_IAP_AUTH_ORIGINAL_URI_HEADER" default:"X-Original-URI" description:"Header in which the reverse proxy calling /auth sets the URI of the request to authorize; only this header is trusted"`
+	OrigHostHeader    string        `long:"original-host-header" env:"GCP_IAP_AUTH_ORIGINAL_HOST_HEADER" default:"X-Original-Host" description:"Header in which the reverse proxy calling /auth sets the host of the request to authorize; only this header is trusted"`
+	OrigMethodHeader  string        `long:"original-method-header" env:"GCP_IAP_AUTH_ORIGINAL_METHOD_HEADER" default:"X-Original-Method" description:"Header in which the reverse proxy calling /auth sets the method of the request to authorize; only this header is trusted"`
+	Policies          []string      `long:"policy" env:"GCP_IAP_AUTH_POLICY" env-delim:"\n" unquote:"false" description:"CEL expression over claims and request that must be true for requests to be allowed, may be given several times (optional)"`
+	GroupsFile        string        `long:"groups-file" env:"GCP_IAP_AUTH_GROUPS_FILE" description:"Path to a JSON, YAML or CSV file mapping email addresses to groups, for use in access rules and policies (optional)"`
+	GroupsReload      time.Duration `long:"groups-reload-interval" env:"GCP_IAP_AUTH_GROUPS_RELOAD_INTERVAL" default:"10s" description:"Check this often whether the groups file changed, and reload it if so"`
+	GroupsHeader      string        `long:"groups-header" env:"GCP_IAP_AUTH_GROUPS_HEADER" description:"Set the comma-separated groups of the authenticated user in the specified header, eg: X-Authenticated-Groups (optional)"`
+	WebhookURL        string        `long:"authz-webhook-url" env:"GCP_IAP_AUTH_AUTHZ_WEBHOOK_URL" description:"URL to POST the identity of authenticated users and the requested route to, for it to allow or deny access (optional)"`
+	WebhookTimeout    time.Duration `long:"authz-webhook-timeout" env:"GCP_IAP_AUTH_AUTHZ_WEBHOOK_TIMEOUT" default:"5s" description:"Timeout for authorization webhook requests"`
+	WebhookCacheTTL   time.Duration `long:"authz-webhook-cache-ttl" env:"GCP_IAP_AUTH_AUTHZ_WEBHOOK_CACHE_TTL" default:"0s" description:"Cache authorization webhook decisions for the same user and route for this long (optional)"`
+	WebhookFailure    string        `long:"authz-webhook-failure" env:"GCP_IAP_AUTH_AUTHZ_WEBHOOK_FAILURE" default:"closed" choice:"closed" choice:"open" description:"When the authorization webhook fails, deny access (closed) or allow it (open)"`
+	WebhookHeaders    string        `long:"authz-webhook-headers" env:"GCP_IAP_AUTH_AUTHZ_WEBHOOK_HEADERS" description:"Comma-separated list of headers the authorization webhook may set, which are removed from incoming requests; any other header it returns is ignored (optional)"`
+	AccessLevels      []string      `long:"require-access-level" env:"GCP_IAP_AUTH_REQUIRE_ACCESS_LEVEL" env-delim:"," description:"Require an access level for a path prefix or glob, as PATH=LEVEL, may be given several times (optional)"`
+	JSONErrors        bool          `long:"json-errors" env:"GCP_IAP_AUTH_JSON_ERRORS" description:"Tell why requests failed in a JSON body, besides the X-Auth-Error header (optional)"`
+	TokenSources      string        `long:"token-sources" env:"GCP_IAP_AUTH_TOKEN_SOURCES" description:"Comma-separated list of places to look for tokens, in order of precedence: header:NAME, bearer, cookie:NAME or query:NAME (optional)"`
 }
 
 func initConfigByArgs(args []string) (*jwt.Config, *Options, error) {
@@ -37,11 +78,20 @@ func initConfigByArgs(args []string) (*jwt.Config, *Options, error) {
 	if opts.Audiences == "" {
 		return nil, nil, errors.New("you must specify --audiences")
 	}
-	cfg := &jwt.Config{}
+	cfg := &jwt.Config{
+		Leeway:      opts.Leeway,
+		MaxTokenAge: opts.MaxTokenAge,
+	}
 	if err := initAudiences(cfg, opts.Audiences); err != nil {
 		return nil, nil, err
 	}
-	if err := initPublicKeys(cfg, opts.PublicKeysPath, opts.PublicKeysUrl); err != nil {
+	if err := initPublicKeys(cfg, opts); err != nil {
+		return nil, nil, err
+	}
+	if err := initOIDC(cfg, opts); err != nil {
+		return nil, nil, err
+	}
+	if err := initTokenSources(cfg, opts.TokenSources); err != nil {
 		return nil, nil, err
 	}
 	return cfg, opts, nil
@@ -62,22 +112,30 @@ func (o *Options) initServerPort() {
 }
 
 func initAudiences(cfg *jwt.Config, audiences string) error {
-	str, err := extractAudiencesRegexp(audiences)
+	re, err := compileAudiences(audiences, parseRawAudience)
 	if err != nil {
 		return err
 	}
+	cfg.MatchAudiences = re
+	return nil
+}
+
+func compileAudiences(audiences string, parseRaw func(string) (string, error)) (*regexp.Regexp, error) {
+	str, err := extractAudiencesRegexp(audiences, parseRaw)
+	if err != nil {
+		return nil, err
+	}
 	re, err := regexp.Compile(str)
 	if err != nil {
-		return fmt.Errorf("Invalid audiences regular expression %q (%v)", str, err)
+		return nil, fmt.Errorf("Invalid audiences regular expression %q (%v)", str, err)
 	}
-	cfg.MatchAudiences = re
-	return nil
+	return re, nil
 }
 
-func extractAudiencesRegexp(audiences string) (string, error) {
+func extractAudiencesRegexp(audiences string, parseRaw func(string) (string, error)) (string, error) {
 	var strs []string
 	for _, audience := range strings.Split(audiences, ",") {
-		str, err := extractAudienceRegexp(audience)
+		str, err := extractAudienceRegexp(audience, parseRaw)
 		if err != nil {
 			return "", err
 		}
@@ -86,14 +144,14 @@ func extractAudiencesRegexp(audiences string) (string, error) {
 	return strings.Join(strs, "|"), nil
 }
 
-func extractAudienceRegexp(audience string) (string, error) {
+func extractAudienceRegexp(audience string, parseRaw func(string) (string, error)) (string, error) {
 	if strings.HasPrefix(audience, "/") && strings.HasSuffix(audience, "/") {
 		if len(audience) < 3 {
 			return "", fmt.Errorf("Invalid audiences regular expression %q", audience)
 		}
 		return audience[1 : len(audience)-1], nil
 	}
-	return parseRawAudience(audience)
+	return parseRaw(audience)
 }
 
 func parseRawAudience(audience string) (string, error) {
@@ -104,10 +162,131 @@ func parseRawAudience(audience string) (string, error) {
 	return fmt.Sprintf("^%s$", regexp.QuoteMeta((string)(*aud))), nil
 }
 
-func initPublicKeys(cfg *jwt.Config, filePath string, keyURL string) error {
-	cfg.PublicKeys = jwt.NewKeyStore(filePath, keyURL)
-	if err := cfg.PublicKeys.UpdateKeys(); err != nil {
+func parseRawOIDCAudience(audience string) (string, error) {
+	if audience == "" {
+		return "", errors.New("Invalid empty audience")
+	}
+	return fmt.Sprintf("^%s$", regexp.QuoteMeta(audience)), nil
+}
+
+func initPublicKeys(cfg *jwt.Config, opts *Options) error {
+	source, err := publicKeySource(opts)
+	if err != nil {
+		return err
+	}
+	cfg.PublicKeys = jwt.NewKeyStoreWithSource(source)
+	cfg.PublicKeys.SetRetiredKeyGracePeriod(opts.PublicKeysGrace)
+	if err := updatePublicKeys(cfg.PublicKeys, opts.PublicKeysCache); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if opts.PublicKeysRefresh > 0 {
+		cfg.PublicKeys.StartRefresh(opts.PublicKeysRefresh)
+	}
+	return nil
+}
+
+// updatePublicKeys updates the keys, caching them to cachePath if it is not
+// empty, and loading them from there if the update fails.
+func updatePublicKeys(keys *jwt.KeyStore, cachePath string) error {
+	keys.SetCachePath(cachePath)
+	err := keys.UpdateKeys()
+	if err == nil || cachePath == "" {
 		return err
 	}
-	return cfg.Validate()
+	cachedAt, cacheErr := keys.LoadCache()
+	if cacheErr != nil {
+		return fmt.Errorf("%w (%v)", err, cacheErr)
+	}
+	log.Printf("WARNING: %v, using public keys cached at %v (%v ago)\n", err, cachedAt.UTC(), time.Since(cachedAt).Round(time.Second))
+	return nil
+}
+
+func publicKeySource(opts *Options) (jwt.KeySource, error) {
+	client, err := publicKeysHTTPClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	fileSource := &jwt.FileKeySource{Path: opts.PublicKeysPath}
+	urlSource := &jwt.URLKeySource{URL: opts.PublicKeysUrl, Client: client}
+	switch {
+	case opts.PublicKeysPath == "":
+		return urlSource, nil
+	case opts.PublicKeysMode == "merge":
+		return jwt.MergedKeySource{urlSource, fileSource}, nil
+	case opts.PublicKeysMode == "failover":
+		return jwt.FailoverKeySource{urlSource, fileSource}, nil
+	}
+	return fileSource, nil
+}
+
+func publicKeysHTTPClient(opts *Options) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.PublicKeysCA != "" {
+		pemCerts, err := os.ReadFile(opts.PublicKeysCA)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA bundle %q (%v)", opts.PublicKeysCA, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %q", opts.PublicKeysCA)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if opts.PublicKeysProxy != "" {
+		proxyURL, err := url.Parse(opts.PublicKeysProxy)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse proxy URL %q (%v)", opts.PublicKeysProxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Client{Timeout: opts.PublicKeysTimeout, Transport: transport}, nil
+}
+
+func initOIDC(cfg *jwt.Config, opts *Options) error {
+	cfg.Profiles = []*jwt.Profile{jwt.NewIAPProfile(cfg.PublicKeys, cfg.MatchAudiences)}
+	if opts.OIDCAudiences == "" {
+		return nil
+	}
+	re, err := compileAudiences(opts.OIDCAudiences, parseRawOIDCAudience)
+	if err != nil {
+		return err
+	}
+	client, err := publicKeysHTTPClient(opts)
+	if err != nil {
+		return err
+	}
+	keys := jwt.NewKeyStoreWithSource(&jwt.URLKeySource{URL: opts.OIDCPublicKeysUrl, Client: client})
+	keys.SetRetiredKeyGracePeriod(opts.PublicKeysGrace)
+	if err := updatePublicKeys(keys, opts.OIDCKeysCache); err != nil {
+		return err
+	}
+	profile := jwt.NewGoogleOIDCProfile(keys, re)
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	if opts.PublicKeysRefresh > 0 {
+		keys.StartRefresh(opts.PublicKeysRefresh)
+	}
+	cfg.Profiles = append(cfg.Profiles, profile)
+	return nil
+}
+
+func initTokenSources(cfg *jwt.Config, sources string) error {
+	if sources == "" {
+		return nil
+	}
+	for _, str := range strings.Split(sources, ",") {
+		source, err := jwt.ParseTokenSource(strings.TrimSpace(str))
+		if err != nil {
+			return fmt.Errorf("Invalid token source (%v)", err)
+		}
+		cfg.TokenSources = append(cfg.TokenSources, source)
+	}
+	return nil
 }
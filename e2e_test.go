@@ -3,19 +3,27 @@ package main
 import (
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"crypto/ecdsa"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/jessevdk/go-flags"
 )
 
 // Mock public key server
@@ -357,3 +365,1028 @@ func TestAuthHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestPublicKeysCA(t *testing.T) {
+	key1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	j, err := json.Marshal(map[string]string{
+		"key1": toPublicKeyString(t, &key1.PublicKey),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal json: %+v", err)
+	}
+	keyServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(j); err != nil {
+			t.Errorf("Failed to write response: %+v", err)
+		}
+	}))
+	defer keyServer.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: keyServer.Certificate().Raw})
+	if err := os.WriteFile(caPath, caPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write CA bundle: %+v", err)
+	}
+
+	args := []string{
+		"--audiences",
+		"/projects/1/global/backendServices/1",
+		"--listen-addr",
+		"127.0.0.1",
+		"--listen-port",
+		"0",
+		"--public-keys-url",
+		keyServer.URL,
+	}
+	if server, err := NewServerWithArgs(args); err == nil {
+		server.Close()
+		t.Fatal("expected untrusted key server to fail, got no error")
+	}
+
+	server, err := NewServerWithArgs(append(args, "--public-keys-ca", caPath))
+	if err != nil {
+		t.Fatalf("Failed to create server: %+v", err)
+	}
+	server.Close()
+}
+
+// startTestServer starts a server trusting a newly generated "key1" key and
+// accepting the testAudience audience, with the given extra arguments.
+func startTestServer(t *testing.T, args ...string) (*server, *ecdsa.PrivateKey) {
+	mockServer := NewMockHttpServer(t)
+	key1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	j, err := json.Marshal(map[string]string{
+		"key1": toPublicKeyString(t, &key1.PublicKey),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal json: %+v", err)
+	}
+	mockServer.SetResponse(j)
+
+	server, err := NewServerWithArgs(append([]string{
+		"--audiences",
+		testAudience,
+		"--listen-addr",
+		"127.0.0.1",
+		"--listen-port",
+		"0",
+		"--public-keys-url",
+		fmt.Sprintf("http://%s/", mockServer.Addr()),
+	}, args...))
+	if err != nil {
+		t.Fatalf("Failed to create server: %+v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			t.Errorf("Failed to start server: %+v", err)
+		}
+	}()
+	return server, key1
+}
+
+const testAudience = "/projects/1/global/backendServices/1"
+
+// testToken returns a valid token for testAudience with the given extra
+// claims, signed with key as "key1".
+func testToken(t *testing.T, key *ecdsa.PrivateKey, extra jwt.MapClaims) string {
+	claims := jwt.MapClaims{
+		"exp": time.Now().Add(1 * time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+		"aud": testAudience,
+		"iss": "https://cloud.google.com/iap",
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = "key1"
+	str, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %+v", err)
+	}
+	return str
+}
+
+// originalRequestHeaders returns the headers a reverse proxy sets when asking
+// /auth to authorize a GET of uri on app.example, overridden by header.
+func originalRequestHeaders(uri string, header map[string]string) map[string]string {
+	h := map[string]string{
+		"X-Original-URI":    uri,
+		"X-Original-Host":   "app.example",
+		"X-Original-Method": http.MethodGet,
+	}
+	for k, v := range header {
+		h[k] = v
+	}
+	return h
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	// The backend echoes the identity headers it receives.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Echo-Email", r.Header.Get("x-goog-authenticated-user-email"))
+		w.Header().Set("X-Echo-Id", r.Header.Get("x-goog-authenticated-user-id"))
+	}))
+	defer backend.Close()
+
+	verifying, key := startTestServer(t, "--identity-headers", "verify", "--backend", backend.URL)
+	rewriting, rewritingKey := startTestServer(t, "--identity-headers", "rewrite", "--backend", backend.URL)
+	identity := jwt.MapClaims{
+		"email": "user@example.com",
+		"sub":   "accounts.google.com:3318417895",
+	}
+
+	testCases := []struct {
+		Name           string
+		Path           string
+		Email          string
+		ID             string
+		ExpectedStatus int
+	}{
+		{"Auth_Match", "/auth", "accounts.google.com:user@example.com", "accounts.google.com:3318417895", http.StatusOK},
+		{"Auth_EmailMismatch", "/auth", "accounts.google.com:admin@example.com", "accounts.google.com:3318417895", http.StatusUnauthorized},
+		{"Auth_IDMismatch", "/auth", "accounts.google.com:user@example.com", "accounts.google.com:1", http.StatusUnauthorized},
+		{"Auth_Missing", "/auth", "", "", http.StatusUnauthorized},
+		{"Proxy_Match", "/app", "accounts.google.com:user@example.com", "accounts.google.com:3318417895", http.StatusOK},
+		{"Proxy_Mismatch", "/app", "accounts.google.com:admin@example.com", "accounts.google.com:3318417895", http.StatusUnauthorized},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", verifying.ListenAddress(), testCase.Path), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %+v", err)
+			}
+			req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, key, identity))
+			if testCase.Email != "" {
+				req.Header.Set("x-goog-authenticated-user-email", testCase.Email)
+			}
+			if testCase.ID != "" {
+				req.Header.Set("x-goog-authenticated-user-id", testCase.ID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %+v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != testCase.ExpectedStatus {
+				t.Errorf("Unexpected response status: %s", resp.Status)
+			}
+		})
+	}
+
+	t.Run("Proxy_Rewrite", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/app", rewriting.ListenAddress()), nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %+v", err)
+		}
+		req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, rewritingKey, identity))
+		req.Header.Set("x-goog-authenticated-user-email", "accounts.google.com:admin@example.com")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %+v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected response status: %s", resp.Status)
+		}
+		if got := resp.Header.Get("X-Echo-Email"); got != "accounts.google.com:user@example.com" {
+			t.Errorf("Unexpected email header: %s", got)
+		}
+		if got := resp.Header.Get("X-Echo-Id"); got != "accounts.google.com:3318417895" {
+			t.Errorf("Unexpected ID header: %s", got)
+		}
+	})
+}
+
+func TestIdentityHeadersOIDC(t *testing.T) {
+	// The backend echoes the identity headers it receives.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Echo-Email", r.Header.Get("x-goog-authenticated-user-email"))
+	}))
+	defer backend.Close()
+
+	oidcKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	j, err := json.Marshal(map[string]string{
+		"oidc1": toPublicKeyString(t, &oidcKey.PublicKey),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal json: %+v", err)
+	}
+	oidcKeys := NewMockHttpServer(t)
+	oidcKeys.SetResponse(j)
+	server, key := startTestServer(t,
+		"--identity-headers", "verify",
+		"--backend", backend.URL,
+		"--oidc-audiences", "https://backend.example.com",
+		"--oidc-public-keys-url", fmt.Sprintf("http://%s/", oidcKeys.Addr()))
+
+	oidcToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"exp":            time.Now().Add(1 * time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"aud":            "https://backend.example.com",
+		"iss":            "https://accounts.google.com",
+		"email":          "robot@example.iam.gserviceaccount.com",
+		"email_verified": true,
+		"sub":            "1234",
+	})
+	oidcToken.Header["kid"] = "oidc1"
+	bearer, err := oidcToken.SignedString(oidcKey)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %+v", err)
+	}
+
+	testCases := []struct {
+		Name           string
+		Path           string
+		IAP            bool
+		Email          string
+		ExpectedStatus int
+	}{
+		{"Auth_OIDC", "/auth", false, "", http.StatusOK},
+		{"Proxy_OIDC", "/app", false, "", http.StatusOK},
+		{"Proxy_OIDCWithHeaders", "/app", false, "accounts.google.com:admin@example.com", http.StatusOK},
+		{"Auth_IAPMissing", "/auth", true, "", http.StatusUnauthorized},
+		{"Proxy_IAPMismatch", "/app", true, "accounts.google.com:admin@example.com", http.StatusUnauthorized},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", server.ListenAddress(), testCase.Path), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %+v", err)
+			}
+			if testCase.IAP {
+				req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, key, jwt.MapClaims{"email": "user@example.com", "sub": "1"}))
+			} else {
+				req.Header.Set("Authorization", "Bearer "+bearer)
+			}
+			if testCase.Email != "" {
+				req.Header.Set("x-goog-authenticated-user-email", testCase.Email)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %+v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != testCase.ExpectedStatus {
+				t.Errorf("Unexpected response status: %s", resp.Status)
+			}
+			if got := resp.Header.Get("X-Echo-Email"); got != "" {
+				t.Errorf("Unexpected email header: %s", got)
+			}
+		})
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	domainsFile := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(domainsFile, []byte("# Allowed domains\ncorp.example\n\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write domains file: %+v", err)
+	}
+	server, key := startTestServer(t,
+		"--allow-emails", "alice@example.com,Bob@Example.com",
+		"--allow-domains-file", domainsFile,
+		"--allow-email-patterns", `.*\+admin@example\.org`,
+	)
+
+	testCases := []struct {
+		Name           string
+		Claims         jwt.MapClaims
+		ExpectedStatus int
+	}{
+		{"Email", jwt.MapClaims{"email": "alice@example.com"}, http.StatusOK},
+		{"EmailCase", jwt.MapClaims{"email": "bob@example.com"}, http.StatusOK},
+		{"HostedDomain", jwt.MapClaims{"email": "carol@other.example", "hd": "corp.example"}, http.StatusOK},
+		{"EmailDomain", jwt.MapClaims{"email": "dave@corp.example"}, http.StatusOK},
+		{"Pattern", jwt.MapClaims{"email": "erin+admin@example.org"}, http.StatusOK},
+		{"PatternPartial", jwt.MapClaims{"email": "erin+admin@example.org.evil"}, http.StatusForbidden},
+		{"Denied", jwt.MapClaims{"email": "mallory@example.com"}, http.StatusForbidden},
+		{"NoEmail", jwt.MapClaims{}, http.StatusForbidden},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/auth", server.ListenAddress()), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %+v", err)
+			}
+			req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, key, testCase.Claims))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %+v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != testCase.ExpectedStatus {
+				t.Errorf("Unexpected response status: %s", resp.Status)
+			}
+		})
+	}
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/auth", server.ListenAddress()), nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %+v", err)
+		}
+		req.Header.Set("x-goog-iap-jwt-assertion", "invalid-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %+v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Unexpected response status: %s", resp.Status)
+		}
+	})
+}
+
+func TestAccessRules(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+  {"name": "admins", "paths": ["/admin/**"], "emails": ["admin@corp.example"], "action": "allow"},
+  {"name": "admin", "paths": ["/admin/**"], "action": "deny"},
+  {"name": "read-only", "paths": ["/api/"], "methods": ["GET"], "domains": ["corp.example"], "action": "allow"},
+  {"name": "api", "paths": ["/api/"], "action": "deny"},
+  {"name": "internal", "hosts": ["*.internal.example"], "action": "deny"},
+  {"name": "default", "domains": ["corp.example"], "action": "allow"}
+]`
+	if err := os.WriteFile(rulesFile, []byte(rules), 0o600); err != nil {
+		t.Fatalf("Failed to write rules file: %+v", err)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	server, key := startTestServer(t, "--access-rules", rulesFile, "--backend", backend.URL)
+
+	admin := jwt.MapClaims{"email": "admin@corp.example"}
+	user := jwt.MapClaims{"email": "user@corp.example"}
+	other := jwt.MapClaims{"email": "user@other.example"}
+	testCases := []struct {
+		Name           string
+		Method         string
+		Path           string
+		Header         map[string]string
+		Claims         jwt.MapClaims
+		ExpectedStatus int
+	}{
+		{"Proxy_Admin", http.MethodGet, "/admin", nil, admin, http.StatusOK},
+		{"Proxy_AdminSubpath", http.MethodPost, "/admin/users", nil, admin, http.StatusOK},
+		{"Proxy_AdminDenied", http.MethodGet, "/admin/users", nil, user, http.StatusForbidden},
+		{"Proxy_Administrator", http.MethodGet, "/administrator", nil, user, http.StatusOK},
+		{"Proxy_APIRead", http.MethodGet, "/api/items", nil, user, http.StatusOK},
+		{"Proxy_APIWrite", http.MethodPost, "/api/items", nil, user, http.StatusForbidden},
+		{"Proxy_APIRoot", http.MethodPost, "/api", nil, user, http.StatusForbidden},
+		{"Proxy_APIPrefix", http.MethodPost, "/apiary", nil, user, http.StatusOK},
+		{"Proxy_OtherDomain", http.MethodGet, "/", nil, other, http.StatusForbidden},
+		{"Auth_OriginalURI", http.MethodGet, "/auth", originalRequestHeaders("/admin/users?x=1", nil), user, http.StatusForbidden},
+		{"Auth_OriginalURIAllowed", http.MethodGet, "/auth", originalRequestHeaders("/admin/users?x=1", nil), admin, http.StatusOK},
+		{"Auth_OriginalURIDotDot", http.MethodGet, "/auth", originalRequestHeaders("/public/../admin/users", nil), user, http.StatusForbidden},
+		{"Auth_OriginalMethod", http.MethodGet, "/auth", originalRequestHeaders("/api/items", map[string]string{"X-Original-Method": "DELETE"}), user, http.StatusForbidden},
+		{"Auth_OriginalHost", http.MethodGet, "/auth", originalRequestHeaders("/", map[string]string{"X-Original-Host": "app.internal.example:443"}), user, http.StatusForbidden},
+		{"Auth_UntrustedHeaders", http.MethodGet, "/auth", originalRequestHeaders("/api/items", map[string]string{"X-Forwarded-Uri": "/admin/users", "X-Forwarded-Method": "DELETE"}), user, http.StatusOK},
+		{"Auth_InvalidURI", http.MethodGet, "/auth", originalRequestHeaders("admin", nil), admin, http.StatusForbidden},
+		{"Auth_MissingOriginalURI", http.MethodGet, "/auth", map[string]string{"X-Original-Host": "app.example", "X-Original-Method": http.MethodGet}, admin, http.StatusForbidden},
+		{"Auth_NoOriginalHeaders", http.MethodGet, "/auth", nil, admin, http.StatusForbidden},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req, err := http.NewRequest(testCase.Method, fmt.Sprintf("http://%s%s", server.ListenAddress(), testCase.Path), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %+v", err)
+			}
+			req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, key, testCase.Claims))
+			for k, v := range testCase.Header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %+v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != testCase.ExpectedStatus {
+				t.Errorf("Unexpected response status: %s", resp.Status)
+			}
+		})
+	}
+
+	t.Run("Auth_SpoofedOriginalURI", func(t *testing.T) {
+		// Behind a proxy setting X-Forwarded-Uri, clients must not be able
+		// to choose the URI being authorized with X-Original-URI.
+		forwarded, forwardedKey := startTestServer(t,
+			"--access-rules", rulesFile,
+			"--original-uri-header", "X-Forwarded-Uri",
+			"--original-host-header", "X-Forwarded-Host",
+			"--original-method-header", "X-Forwarded-Method",
+		)
+		for forwardedURI, expectedStatus := range map[string]int{"/admin/users": http.StatusForbidden, "/public": http.StatusOK} {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/auth", forwarded.ListenAddress()), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %+v", err)
+			}
+			req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, forwardedKey, user))
+			req.Header.Set("X-Original-URI", "/public")
+			req.Header.Set("X-Forwarded-Uri", forwardedURI)
+			req.Header.Set("X-Forwarded-Host", "app.example")
+			req.Header.Set("X-Forwarded-Method", http.MethodGet)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %+v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != expectedStatus {
+				t.Errorf("%s: unexpected response status: %s", forwardedURI, resp.Status)
+			}
+		}
+	})
+}
+
+func TestPolicies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	server, key := startTestServer(t,
+		"--backend", backend.URL,
+		"--policy", `claims.hd == "corp.example"`,
+		"--policy", `!request.path.startsWith("/billing") || "levels/trusted_device" in claims.access_levels`,
+	)
+
+	trusted := jwt.MapClaims{
+		"email":  "user@corp.example",
+		"hd":     "corp.example",
+		"google": map[string]interface{}{"access_levels": []string{"levels/trusted_device"}},
+	}
+	untrusted := jwt.MapClaims{"email": "user@corp.example", "hd": "corp.example"}
+	other := jwt.MapClaims{"email": "user@other.example", "hd": "other.example"}
+	testCases := []struct {
+		Name           string
+		Path           string
+		Header         map[string]string
+		Claims         jwt.MapClaims
+		ExpectedStatus int
+	}{
+		{"Proxy_Trusted", "/billing/invoices", nil, trusted, http.StatusOK},
+		{"Proxy_Untrusted", "/billing/invoices", nil, untrusted, http.StatusForbidden},
+		{"Proxy_UntrustedElsewhere", "/home", nil, untrusted, http.StatusOK},
+		{"Proxy_OtherDomain", "/home", nil, other, http.StatusForbidden},
+		{"Auth_Untrusted", "/auth", originalRequestHeaders("/billing", nil), untrusted, http.StatusForbidden},
+		{"Auth_Trusted", "/auth", originalRequestHeaders("/billing", nil), trusted, http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", server.ListenAddress(), testCase.Path), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %+v", err)
+			}
+			req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, key, testCase.Claims))
+			for k, v := range testCase.Header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %+v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != testCase.ExpectedStatus {
+				t.Errorf("Unexpected response status: %s", resp.Status)
+			}
+		})
+	}
+
+	t.Run("RawClaims", func(t *testing.T) {
+		raw, rawKey := startTestServer(t, "--policy", `claims.raw.team == "billing"`)
+		for team, expectedStatus := range map[string]int{"billing": http.StatusOK, "sales": http.StatusForbidden} {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/auth", raw.ListenAddress()), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %+v", err)
+			}
+			req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, rawKey, jwt.MapClaims{"team": team}))
+			for k, v := range originalRequestHeaders("/", nil) {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %+v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != expectedStatus {
+				t.Errorf("%s: unexpected response status: %s", team, resp.Status)
+			}
+		}
+	})
+
+	t.Run("InvalidPolicy", func(t *testing.T) {
+		for _, expr := range []string{
+			`claims.hd ==`,
+			`size(claims.hd)`,
+			`"a" + 1 == "b"`,
+			`claims.emial == "a@b" && request.pth.startsWith("/x")`,
+			`claims.email + 1 == 2`,
+			`request.headers["x-team"] == 1`,
+		} {
+			if _, err := compilePolicies([]string{expr}); err == nil {
+				t.Errorf("%s: expected error", expr)
+			}
+		}
+	})
+}
+
+func TestGroups(t *testing.T) {
+	groupsFile := filepath.Join(t.TempDir(), "groups.json")
+	writeGroups := func(groups string) {
+		if err := os.WriteFile(groupsFile, []byte(groups), 0o600); err != nil {
+			t.Fatalf("Failed to write groups file: %+v", err)
+		}
+	}
+	writeGroups(`{"admin@corp.example": ["admins", "eng"], "user@corp.example": ["eng"]}`)
+	rulesFile := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+  {"paths": ["/admin/**"], "groups": ["admins"], "action": "allow"},
+  {"paths": ["/admin/**"], "action": "deny"},
+  {"action": "allow"}
+]`
+	if err := os.WriteFile(rulesFile, []byte(rules), 0o600); err != nil {
+		t.Fatalf("Failed to write rules file: %+v", err)
+	}
+	// The backend echoes the groups header it receives.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Echo-Groups", r.Header.Get("X-Authenticated-Groups"))
+	}))
+	defer backend.Close()
+	server, key := startTestServer(t,
+		"--backend", backend.URL,
+		"--groups-file", groupsFile,
+		"--groups-reload-interval", "10ms",
+		"--groups-header", "X-Authenticated-Groups",
+		"--access-rules", rulesFile,
+		"--policy", `"eng" in groups`,
+	)
+
+	get := func(t *testing.T, path, email string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", server.ListenAddress(), path), nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %+v", err)
+		}
+		req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, key, jwt.MapClaims{"email": email}))
+		req.Header.Set("X-Authenticated-Groups", "forged")
+		for k, v := range originalRequestHeaders(path, nil) {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %+v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	testCases := []struct {
+		Name           string
+		Path           string
+		Email          string
+		ExpectedStatus int
+		ExpectedGroups string
+	}{
+		{"Admin", "/admin/", "Admin@corp.example", http.StatusOK, "admins,eng"},
+		{"User", "/home", "user@corp.example", http.StatusOK, "eng"},
+		{"UserAdmin", "/admin/", "user@corp.example", http.StatusForbidden, ""},
+		{"NoGroups", "/home", "other@corp.example", http.StatusForbidden, ""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			resp := get(t, testCase.Path, testCase.Email)
+			if resp.StatusCode != testCase.ExpectedStatus {
+				t.Errorf("Unexpected response status: %s", resp.Status)
+			}
+			if got := resp.Header.Get("X-Echo-Groups"); got != testCase.ExpectedGroups {
+				t.Errorf("Unexpected groups header: %q", got)
+			}
+		})
+	}
+
+	t.Run("Auth", func(t *testing.T) {
+		resp := get(t, "/auth", "admin@corp.example")
+		if got := resp.Header.Get("X-Authenticated-Groups"); got != "admins,eng" {
+			t.Errorf("Unexpected groups header: %q", got)
+		}
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		writeGroups(`{"user@corp.example": ["admins", "eng"], "other@corp.example": ["eng"]}`)
+		deadline := time.Now().Add(5 * time.Second)
+		for get(t, "/admin/", "user@corp.example").StatusCode != http.StatusOK {
+			if time.Now().After(deadline) {
+				t.Fatal("groups were not reloaded")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if resp := get(t, "/home", "other@corp.example"); resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected response status: %s", resp.Status)
+		}
+	})
+}
+
+func TestDecodeGroups(t *testing.T) {
+	want := map[string][]string{
+		"a@example.com": {"admins", "eng"},
+		"b@example.com": {"eng"},
+	}
+	files := map[string]string{
+		".json": `{"a@example.com": ["admins", "eng"], "b@example.com": ["eng"]}`,
+		".yaml": "a@example.com: [admins, eng]\nb@example.com:\n  - eng\n",
+		".csv":  "# email,groups...\na@example.com,admins,eng\nb@example.com,eng\n",
+	}
+	for ext, data := range files {
+		got, err := decodeGroups(ext, []byte(data))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", ext, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v, want %v", ext, got, want)
+		}
+	}
+	if _, err := decodeGroups(".txt", nil); err == nil {
+		t.Error("expected error for unsupported extension")
+	}
+}
+
+func TestAuthzWebhook(t *testing.T) {
+	const otherAudience = "/projects/1/global/backendServices/2"
+	var calls atomic.Int32
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var body webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Failed to decode webhook request: %+v", err)
+		}
+		if body.Email != "user@corp.example" || (body.Audience != testAudience && body.Audience != otherAudience) {
+			t.Errorf("Unexpected webhook request: %+v", body)
+		}
+		if body.Audience != testAudience {
+			json.NewEncoder(w).Encode(&webhookResponse{Allow: false, Reason: "other backend"})
+			return
+		}
+		switch body.Path {
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/invalid":
+			io.WriteString(w, "allow")
+		case "/denied":
+			json.NewEncoder(w).Encode(&webhookResponse{Allow: false, Reason: "not entitled"})
+		case "/plain":
+			json.NewEncoder(w).Encode(&webhookResponse{Allow: true, Headers: map[string]string{"X-Undeclared": "1"}})
+		default:
+			json.NewEncoder(w).Encode(&webhookResponse{Allow: true, Headers: map[string]string{"X-Entitlement": "gold"}})
+		}
+	}))
+	defer authz.Close()
+	// The backend echoes the header injected by the webhook.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Echo-Entitlement", r.Header.Get("X-Entitlement"))
+		w.Header().Set("X-Echo-Undeclared", r.Header.Get("X-Undeclared"))
+	}))
+	defer backend.Close()
+	closed, closedKey := startTestServer(t,
+		"--audiences", testAudience+","+otherAudience,
+		"--backend", backend.URL,
+		"--authz-webhook-url", authz.URL,
+		"--authz-webhook-cache-ttl", "1m",
+		"--authz-webhook-headers", "x-entitlement",
+	)
+	open, openKey := startTestServer(t,
+		"--backend", backend.URL,
+		"--authz-webhook-url", authz.URL,
+		"--authz-webhook-failure", "open",
+		"--authz-webhook-headers", "X-Entitlement",
+	)
+
+	get := func(t *testing.T, srv *server, key *ecdsa.PrivateKey, path string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", srv.ListenAddress(), path), nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %+v", err)
+		}
+		req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, key, jwt.MapClaims{"email": "user@corp.example"}))
+		req.Header.Set("X-Entitlement", "forged")
+		for k, v := range originalRequestHeaders(path, nil) {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %+v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("Allowed", func(t *testing.T) {
+		resp := get(t, closed, closedKey, "/app")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected response status: %s", resp.Status)
+		}
+		if got := resp.Header.Get("X-Echo-Entitlement"); got != "gold" {
+			t.Errorf("Unexpected injected header: %q", got)
+		}
+	})
+	t.Run("NoHeaders", func(t *testing.T) {
+		resp := get(t, closed, closedKey, "/plain")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected response status: %s", resp.Status)
+		}
+		if got := resp.Header.Get("X-Echo-Entitlement"); got != "" {
+			t.Errorf("Unexpected forged header: %q", got)
+		}
+		if got := resp.Header.Get("X-Echo-Undeclared"); got != "" {
+			t.Errorf("Unexpected undeclared header: %q", got)
+		}
+	})
+	t.Run("Denied", func(t *testing.T) {
+		if resp := get(t, closed, closedKey, "/denied"); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Unexpected response status: %s", resp.Status)
+		}
+	})
+	t.Run("Cached", func(t *testing.T) {
+		before := calls.Load()
+		get(t, closed, closedKey, "/app")
+		get(t, closed, closedKey, "/denied")
+		if after := calls.Load(); after != before {
+			t.Errorf("Expected cached decisions, got %d webhook calls", after-before)
+		}
+	})
+	t.Run("CachedPerAudience", func(t *testing.T) {
+		get(t, closed, closedKey, "/app")
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/app", closed.ListenAddress()), nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %+v", err)
+		}
+		req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, closedKey, jwt.MapClaims{"email": "user@corp.example", "aud": otherAudience}))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %+v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Unexpected response status: %s", resp.Status)
+		}
+	})
+	t.Run("Auth", func(t *testing.T) {
+		resp := get(t, closed, closedKey, "/auth")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected response status: %s", resp.Status)
+		}
+		if got := resp.Header.Get("X-Entitlement"); got != "gold" {
+			t.Errorf("Unexpected injected header: %q", got)
+		}
+	})
+	t.Run("FailClosed", func(t *testing.T) {
+		if resp := get(t, closed, closedKey, "/error"); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Unexpected response status: %s", resp.Status)
+		}
+	})
+	t.Run("FailOpen", func(t *testing.T) {
+		if resp := get(t, open, openKey, "/error"); resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected response status: %s", resp.Status)
+		}
+	})
+	t.Run("FailOpenDenied", func(t *testing.T) {
+		// Replies other than 5xx are answers, which must not fail open.
+		for _, path := range []string{"/forbidden", "/invalid"} {
+			if resp := get(t, open, openKey, path); resp.StatusCode != http.StatusForbidden {
+				t.Errorf("%s: unexpected response status: %s", path, resp.Status)
+			}
+		}
+	})
+	t.Run("CacheEviction", func(t *testing.T) {
+		w := &webhook{cacheTTL: time.Minute, cache: make(map[webhookRequestKey]webhookCacheEntry)}
+		for i := 0; i < maxWebhookCacheEntries; i++ {
+			w.store(webhookRequestKey{path: fmt.Sprintf("/%d", i)}, &webhookResponse{Allow: true})
+		}
+		// Make sure the first decision expires first.
+		w.cache[webhookRequestKey{path: "/0"}] = webhookCacheEntry{resp: &webhookResponse{Allow: true}, expires: time.Now().Add(time.Second)}
+		w.store(webhookRequestKey{path: fmt.Sprintf("/%d", maxWebhookCacheEntries)}, &webhookResponse{Allow: true})
+		if len(w.cache) != maxWebhookCacheEntries {
+			t.Errorf("Unexpected number of cached decisions: %d", len(w.cache))
+		}
+		if _, ok := w.cached(webhookRequestKey{path: "/0"}); ok {
+			t.Error("Expected the oldest decision to be dropped")
+		}
+		if _, ok := w.cached(webhookRequestKey{path: fmt.Sprintf("/%d", maxWebhookCacheEntries)}); !ok {
+			t.Error("Expected the newest decision to be cached")
+		}
+	})
+	t.Run("InvalidConfig", func(t *testing.T) {
+		for _, args := range [][]string{
+			{"--authz-webhook-url", authz.URL, "--authz-webhook-timeout", "0s"},
+			{"--authz-webhook-url", authz.URL, "--authz-webhook-timeout", "-1s"},
+			{"--authz-webhook-url", "authz.example.com/check"},
+			{"--authz-webhook-url", "http://%zz"},
+		} {
+			opts := &Options{}
+			if _, err := flags.ParseArgs(opts, args); err != nil {
+				t.Fatalf("Failed to parse arguments: %+v", err)
+			}
+			if _, err := newAccess(opts); err == nil {
+				t.Errorf("%q: expected error", args)
+			}
+		}
+	})
+}
+
+func TestAccessLevels(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	const corpDevice = "accessPolicies/123/accessLevels/corp_device"
+	const mfa = "accessPolicies/123/accessLevels/mfa"
+	server, key := startTestServer(t,
+		"--backend", backend.URL,
+		"--require-access-level", "/finance="+corpDevice,
+		"--require-access-level", "/finance/payroll/**="+mfa,
+	)
+
+	testCases := []struct {
+		Name           string
+		Path           string
+		Header         map[string]string
+		Levels         []string
+		ExpectedStatus int
+		ExpectedBody   string
+	}{
+		{"Unrestricted", "/home", nil, nil, http.StatusOK, ""},
+		{"Allowed", "/finance/reports", nil, []string{corpDevice}, http.StatusOK, ""},
+		{"OtherSegment", "/financial", nil, nil, http.StatusOK, ""},
+		{"Missing", "/finance/reports", nil, []string{mfa}, http.StatusForbidden, `Forbidden: missing access level "` + corpDevice + `"`},
+		{"MissingSecond", "/finance/payroll", nil, []string{corpDevice}, http.StatusForbidden, `Forbidden: missing access level "` + mfa + `"`},
+		{"AllowedBoth", "/finance/payroll/2024", nil, []string{corpDevice, mfa}, http.StatusOK, ""},
+		{"Auth_Missing", "/auth", originalRequestHeaders("/finance", nil), nil, http.StatusForbidden, `Forbidden: missing access level "` + corpDevice + `"`},
+		{"Auth_NoOriginalURI", "/auth", nil, nil, http.StatusForbidden, "Forbidden"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", server.ListenAddress(), testCase.Path), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %+v", err)
+			}
+			claims := jwt.MapClaims{"email": "user@corp.example"}
+			if testCase.Levels != nil {
+				claims["google"] = map[string]interface{}{"access_levels": testCase.Levels}
+			}
+			req.Header.Set("x-goog-iap-jwt-assertion", testToken(t, key, claims))
+			for k, v := range testCase.Header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %+v", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("Failed to read response: %+v", err)
+			}
+			if resp.StatusCode != testCase.ExpectedStatus {
+				t.Errorf("Unexpected response status: %s", resp.Status)
+			}
+			if testCase.ExpectedBody != "" && strings.TrimSpace(string(body)) != testCase.ExpectedBody {
+				t.Errorf("Unexpected response body: %q", body)
+			}
+		})
+	}
+}
+
+func TestAuthErrors(t *testing.T) {
+	textServer, textKey := startTestServer(t, "--allow-domains", "corp.example")
+	jsonServer, jsonKey := startTestServer(t, "--allow-domains", "corp.example", "--json-errors")
+
+	testCases := []struct {
+		Name           string
+		Token          func(key *ecdsa.PrivateKey) string
+		ExpectedStatus int
+		ExpectedError  string
+	}{
+		{"Allowed", func(key *ecdsa.PrivateKey) string {
+			return testToken(t, key, jwt.MapClaims{"email": "user@corp.example"})
+		}, http.StatusOK, ""},
+		{"MissingToken", func(key *ecdsa.PrivateKey) string { return "" }, http.StatusUnauthorized, "missing_token"},
+		{"MalformedToken", func(key *ecdsa.PrivateKey) string { return "invalid-token" }, http.StatusUnauthorized, "malformed_token"},
+		{"ExpiredToken", func(key *ecdsa.PrivateKey) string {
+			return testToken(t, key, jwt.MapClaims{
+				"email": "user@corp.example",
+				"exp":   time.Now().Add(-1 * time.Hour).Unix(),
+				"iat":   time.Now().Add(-65 * time.Minute).Unix(),
+			})
+		}, http.StatusUnauthorized, "token_expired"},
+		{"InvalidAudience", func(key *ecdsa.PrivateKey) string {
+			return testToken(t, key, jwt.MapClaims{"email": "user@corp.example", "aud": "/projects/2/global/backendServices/2"})
+		}, http.StatusUnauthorized, "invalid_audience"},
+		{"Denied", func(key *ecdsa.PrivateKey) string {
+			return testToken(t, key, jwt.MapClaims{"email": "user@other.example"})
+		}, http.StatusForbidden, "access_denied"},
+	}
+	for _, testCase := range testCases {
+		for _, srv := range []struct {
+			Name   string
+			Server *server
+			Key    *ecdsa.PrivateKey
+			JSON   bool
+		}{{"Text", textServer, textKey, false}, {"JSON", jsonServer, jsonKey, true}} {
+			t.Run(testCase.Name+"_"+srv.Name, func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/auth", srv.Server.ListenAddress()), nil)
+				if err != nil {
+					t.Fatalf("Failed to create request: %+v", err)
+				}
+				if token := testCase.Token(srv.Key); token != "" {
+					req.Header.Set("x-goog-iap-jwt-assertion", token)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("Failed to send request: %+v", err)
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != testCase.ExpectedStatus {
+					t.Errorf("Unexpected response status: %s", resp.Status)
+				}
+				if got := resp.Header.Get("X-Auth-Error"); got != testCase.ExpectedError {
+					t.Errorf("Unexpected X-Auth-Error header: %q", got)
+				}
+				if !srv.JSON || testCase.ExpectedError == "" {
+					return
+				}
+				var body failureBody
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					t.Fatalf("Failed to decode response: %+v", err)
+				}
+				if body.Error != testCase.ExpectedError || body.Message == "" {
+					t.Errorf("Unexpected response body: %+v", body)
+				}
+			})
+		}
+	}
+}
+
+func TestPublicKeysCacheFallback(t *testing.T) {
+	mockServer := NewMockHttpServer(t)
+	key1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	j, err := json.Marshal(map[string]string{
+		"key1": toPublicKeyString(t, &key1.PublicKey),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal json: %+v", err)
+	}
+	mockServer.SetResponse(j)
+	dir := t.TempDir()
+	args := func(keysURL string) []string {
+		return []string{
+			"--audiences", testAudience,
+			"--listen-addr", "127.0.0.1",
+			"--listen-port", "0",
+			"--public-keys-url", keysURL,
+			"--public-keys-cache", filepath.Join(dir, "iap.json"),
+			"--oidc-audiences", "https://backend.example.com",
+			"--oidc-public-keys-url", keysURL,
+			"--oidc-public-keys-cache", filepath.Join(dir, "oidc.json"),
+		}
+	}
+
+	server, err := NewServerWithArgs(args(fmt.Sprintf("http://%s/", mockServer.Addr())))
+	if err != nil {
+		t.Fatalf("Failed to create server: %+v", err)
+	}
+	server.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	server, err = NewServerWithArgs(args(unreachable.URL))
+	if err != nil {
+		t.Fatalf("Failed to create server from cache: %+v", err)
+	}
+	defer server.Close()
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			t.Errorf("Failed to start server: %+v", err)
+		}
+	}()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/healthz", server.ListenAddress()))
+	if err != nil {
+		t.Fatalf("Failed to send request: %+v", err)
+	}
+	defer resp.Body.Close()
+	var h healthz
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		t.Fatalf("Failed to decode response: %+v", err)
+	}
+	for _, name := range []string{"iap", "google-oidc"} {
+		cache := h.PublicKeysCache[name]
+		if cache == nil || cache.CachedAt.IsZero() || cache.AgeSeconds < 0 || cache.AgeSeconds > 60 {
+			t.Errorf("Unexpected cache of %s public keys: %+v", name, cache)
+		}
+	}
+}
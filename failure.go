@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/imkira/gcp-iap-auth/jwt"
+)
+
+// failureCodes maps errors to the reason codes of the X-Auth-Error header.
+// More specific errors come first.
+var failureCodes = []struct {
+	err  error
+	code string
+}{
+	{jwt.ErrMissingToken, "missing_token"},
+	{jwt.ErrConflictingTokens, "conflicting_tokens"},
+	{jwt.ErrMalformedToken, "malformed_token"},
+	{jwt.ErrInvalidAlgorithm, "invalid_algorithm"},
+	{jwt.ErrUnknownKeyID, "unknown_key_id"},
+	{jwt.ErrInvalidSignature, "invalid_signature"},
+	{jwt.ErrTokenExpired, "token_expired"},
+	{jwt.ErrTokenNotValidYet, "token_not_valid_yet"},
+	{jwt.ErrTokenTooOld, "token_too_old"},
+	{jwt.ErrInvalidIssuer, "invalid_issuer"},
+	{jwt.ErrInvalidAudience, "invalid_audience"},
+	{jwt.ErrUnverifiedEmail, "unverified_email"},
+	{errIdentityTampering, "identity_mismatch"},
+	{errAccessDenied, "access_denied"},
+}
+
+// failureBody is the JSON body of responses to failed requests.
+type failureBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// failureHandler returns the handler of requests that failed authentication
+// or authorization. It logs the failure and tells its reason code in the
+// X-Auth-Error header and, if jsonBody is set, in a JSON body.
+func failureHandler(jsonBody bool) jwt.ErrorHandler {
+	return func(res http.ResponseWriter, req *http.Request, claims *jwt.Claims, err error) {
+		logAuthFailure(claims, err)
+		status := failureStatus(err)
+		code, msg := failureReason(err)
+		res.Header().Set("X-Auth-Error", code)
+		if !jsonBody {
+			text := http.StatusText(status)
+			if reason := failureMessage(err); reason != "" {
+				text += ": " + reason
+			}
+			http.Error(res, text, status)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Header().Set("X-Content-Type-Options", "nosniff")
+		res.WriteHeader(status)
+		if err := json.NewEncoder(res).Encode(&failureBody{Error: code, Message: msg}); err != nil {
+			log.Printf("Failed to write response: %v", err)
+		}
+	}
+}
+
+// failureReason returns the reason code and message of err. Messages do not
+// include the details of err, which are only logged.
+func failureReason(err error) (string, string) {
+	var levelErr *accessLevelError
+	if errors.As(err, &levelErr) {
+		return "missing_access_level", failureMessage(err)
+	}
+	for _, c := range failureCodes {
+		if errors.Is(err, c.err) {
+			return c.code, c.err.Error()
+		}
+	}
+	return "invalid_token", "invalid token"
+}
+
+// failureMessage returns the message telling users why they are denied
+// access, or an empty string if they need not be told.
+func failureMessage(err error) string {
+	var levelErr *accessLevelError
+	if errors.As(err, &levelErr) {
+		return fmt.Sprintf("missing access level %q", levelErr.level)
+	}
+	return ""
+}
+
+// failureStatus returns the HTTP status code for requests that failed
+// authentication or authorization with err.
+func failureStatus(err error) int {
+	if errors.Is(err, errAccessDenied) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+func logAuthFailure(claims *jwt.Claims, err error) {
+	if errors.Is(err, errAccessDenied) {
+		log.Printf("Denied %q (%v)\n", claims.Email, err)
+	} else if claims == nil || len(claims.Email) == 0 {
+		log.Printf("Failed to authenticate (%v)\n", err)
+	} else {
+		log.Printf("Failed to authenticate %q (%v)\n", claims.Email, err)
+	}
+}
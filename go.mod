@@ -1,12 +1,25 @@
 module github.com/imkira/gcp-iap-auth
 
-go 1.22
+go 1.22.0
 
 toolchain go1.22.1
 
 require (
 	github.com/golang-jwt/jwt/v4 v4.4.2
+	github.com/google/cel-go v0.26.1
 	github.com/jessevdk/go-flags v1.6.1
+	golang.org/x/sync v0.11.0
+	google.golang.org/protobuf v1.34.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/sys v0.21.0 // indirect
+require (
+	cel.dev/expr v0.24.0 // indirect
+	github.com/antlr4-go/antlr/v4 v4.13.0 // indirect
+	github.com/stoewer/go-strcase v1.2.0 // indirect
+	golang.org/x/exp v0.0.0-20230515195305-f3d0a9c9a5cc // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+	google.golang.org/genproto/googleapis/api v0.0.0-20240826202546-f6391c0de4c7 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240826202546-f6391c0de4c7 // indirect
+)
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type groupsContextKey struct{}
+
+// newGroupsContext returns a context holding the groups of the user.
+func newGroupsContext(ctx context.Context, groups []string) context.Context {
+	return context.WithValue(ctx, groupsContextKey{}, groups)
+}
+
+// groupsFromContext returns the groups of the user held by ctx.
+func groupsFromContext(ctx context.Context) []string {
+	groups, _ := ctx.Value(groupsContextKey{}).([]string)
+	return groups
+}
+
+// groupDirectory maps email addresses to the groups they belong to, as read
+// from a JSON, YAML or CSV file that is reloaded when it changes.
+type groupDirectory struct {
+	path    string
+	lock    sync.RWMutex
+	groups  map[string][]string
+	modTime time.Time
+	size    int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// loadGroupDirectory loads the group file at path and, if interval is
+// positive, checks every interval whether it changed.
+func loadGroupDirectory(path string, interval time.Duration) (*groupDirectory, error) {
+	d := &groupDirectory{path: path}
+	if _, err := d.reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		d.stop = make(chan struct{})
+		d.done = make(chan struct{})
+		go d.watch(interval)
+	}
+	return d, nil
+}
+
+// Groups returns the sorted groups of the user with the given email address.
+func (d *groupDirectory) Groups(email string) []string {
+	if d == nil {
+		return nil
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.groups[strings.ToLower(email)]
+}
+
+// Close stops checking whether the group file changed.
+func (d *groupDirectory) Close() error {
+	if d == nil || d.stop == nil {
+		return nil
+	}
+	close(d.stop)
+	<-d.done
+	return nil
+}
+
+func (d *groupDirectory) watch(interval time.Duration) {
+	defer close(d.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			if reloaded, err := d.reload(); err != nil {
+				log.Printf("Failed to reload groups (%v)\n", err)
+			} else if reloaded {
+				log.Printf("Reloaded groups from %q\n", d.path)
+			}
+		}
+	}
+}
+
+// reload loads the group file again if its modification time or size
+// changed. The groups are left untouched if loading fails.
+func (d *groupDirectory) reload() (bool, error) {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return false, fmt.Errorf("Could not read groups %q (%v)", d.path, err)
+	}
+	d.lock.RLock()
+	unchanged := d.groups != nil && info.ModTime().Equal(d.modTime) && info.Size() == d.size
+	d.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return false, fmt.Errorf("Could not read groups %q (%v)", d.path, err)
+	}
+	members, err := decodeGroups(filepath.Ext(d.path), data)
+	if err != nil {
+		return false, fmt.Errorf("Could not parse groups %q (%v)", d.path, err)
+	}
+	groups := make(map[string][]string, len(members))
+	for email, gs := range members {
+		email = strings.ToLower(strings.TrimSpace(email))
+		groups[email] = append(groups[email], gs...)
+	}
+	for email, gs := range groups {
+		groups[email] = uniqueSorted(gs)
+	}
+	d.lock.Lock()
+	d.groups = groups
+	d.modTime = info.ModTime()
+	d.size = info.Size()
+	d.lock.Unlock()
+	return true, nil
+}
+
+// decodeGroups decodes a mapping of email addresses to groups. JSON and YAML
+// files hold an object mapping each email address to a list of groups, and
+// CSV files have rows of an email address followed by groups.
+func decodeGroups(ext string, data []byte) (map[string][]string, error) {
+	members := make(map[string][]string)
+	switch strings.ToLower(ext) {
+	case ".json":
+		if err := json.Unmarshal(data, &members); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &members); err != nil {
+			return nil, err
+		}
+	case ".csv":
+		r := csv.NewReader(bytes.NewReader(data))
+		r.FieldsPerRecord = -1
+		r.Comment = '#'
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(record) < 2 {
+				return nil, fmt.Errorf("expected an email address followed by groups, got %q", record)
+			}
+			for _, group := range record[1:] {
+				if group = strings.TrimSpace(group); group != "" {
+					members[record[0]] = append(members[record[0]], group)
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported file extension %q (must be .json, .yaml, .yml or .csv)", ext)
+	}
+	return members, nil
+}
+
+func uniqueSorted(list []string) []string {
+	sort.Strings(list)
+	ret := list[:0]
+	for _, v := range list {
+		if len(ret) == 0 || v != ret[len(ret)-1] {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
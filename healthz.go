@@ -1,12 +1,46 @@
 package main
 
 import (
-	"fmt"
+	"encoding/json"
+	"log"
 	"net/http"
+	"time"
+
+	"github.com/imkira/gcp-iap-auth/jwt"
 )
 
-func healthzHandler(res http.ResponseWriter, req *http.Request) {
-	res.Header().Set("Content-Type", "application/json")
-	res.WriteHeader(200)
-	fmt.Fprintln(res, `{"status":"green"}`)
+type healthz struct {
+	Status string `json:"status"`
+	// PublicKeysCache tells, for each profile whose public keys were loaded
+	// from the cache instead of being fetched, how old the cache is.
+	PublicKeysCache map[string]*healthzCache `json:"public_keys_cache,omitempty"`
+}
+
+type healthzCache struct {
+	CachedAt   time.Time `json:"cached_at"`
+	AgeSeconds int64     `json:"age_seconds"`
+}
+
+func healthzHandler(cfg *jwt.Config) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		h := &healthz{Status: "green"}
+		for _, profile := range cfg.Profiles {
+			cachedAt := profile.PublicKeys.CachedAt()
+			if cachedAt.IsZero() {
+				continue
+			}
+			if h.PublicKeysCache == nil {
+				h.PublicKeysCache = make(map[string]*healthzCache)
+			}
+			h.PublicKeysCache[profile.Name] = &healthzCache{
+				CachedAt:   cachedAt.UTC(),
+				AgeSeconds: int64(time.Since(cachedAt) / time.Second),
+			}
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(200)
+		if err := json.NewEncoder(res).Encode(h); err != nil {
+			log.Printf("Failed to write response: %v", err)
+		}
+	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/imkira/gcp-iap-auth/jwt"
+)
+
+const (
+	userEmailHeader = "X-Goog-Authenticated-User-Email"
+	userIDHeader    = "X-Goog-Authenticated-User-Id"
+	identityPrefix  = "accounts.google.com:"
+)
+
+// identityMode tells what to do with the identity headers IAP sends along
+// with the token.
+type identityMode string
+
+const (
+	// identityIgnore leaves the identity headers untouched.
+	identityIgnore identityMode = "ignore"
+	// identityVerify rejects requests whose identity headers do not match
+	// the verified token.
+	identityVerify identityMode = "verify"
+	// identityRewrite replaces the identity headers with the values of the
+	// verified token.
+	identityRewrite identityMode = "rewrite"
+)
+
+var errIdentityTampering = errors.New("possible tampering")
+
+// checkIdentityHeaders checks that the identity headers of the request match
+// the verified claims, ignoring the "accounts.google.com:" prefix.
+func checkIdentityHeaders(header http.Header, claims *jwt.Claims) error {
+	if err := checkIdentityHeader(header, userEmailHeader, claims.Email); err != nil {
+		return err
+	}
+	return checkIdentityHeader(header, userIDHeader, claims.Subject)
+}
+
+func checkIdentityHeader(header http.Header, name, want string) error {
+	values := header.Values(name)
+	if len(values) != 1 {
+		return fmt.Errorf("%w: expected one %s header, got %d", errIdentityTampering, name, len(values))
+	}
+	if got := values[0]; strings.TrimPrefix(got, identityPrefix) != strings.TrimPrefix(want, identityPrefix) {
+		return fmt.Errorf("%w: %s header %q does not match the token", errIdentityTampering, name, got)
+	}
+	return nil
+}
+
+// iapToken reports whether the claims come from a token signed by IAP. Only
+// those come along with identity headers: requests authenticated otherwise,
+// such as with OpenID Connect bearer tokens, never carry legitimate ones.
+func iapToken(claims *jwt.Claims) bool {
+	return claims.Profile().Name == jwt.IAPProfileName
+}
+
+// setIdentityHeaders sets the identity headers from the verified claims.
+func setIdentityHeaders(header http.Header, claims *jwt.Claims) {
+	setIdentityHeader(header, userEmailHeader, claims.Email)
+	setIdentityHeader(header, userIDHeader, claims.Subject)
+}
+
+// removeIdentityHeaders removes the identity headers.
+func removeIdentityHeaders(header http.Header) {
+	header.Del(userEmailHeader)
+	header.Del(userIDHeader)
+}
+
+func setIdentityHeader(header http.Header, name, value string) {
+	if value == "" {
+		header.Del(name)
+		return
+	}
+	header.Set(name, identityPrefix+strings.TrimPrefix(value, identityPrefix))
+}
@@ -10,8 +10,50 @@ import (
 // Audience must be a string with the following values:
 // * App Engine: /projects/PROJECT_NUMBER/apps/PROJECT_ID
 // * Compute Engine and Container Engine: /projects/PROJECT_NUMBER/global/backendServices/SERVICE_ID
+// * Regional backend services: /projects/PROJECT_NUMBER/locations/REGION/backendServices/SERVICE_ID
+// * Cloud Run: /projects/PROJECT_NUMBER/locations/REGION/services/SERVICE_NAME
 type Audience string
 
+// AudienceKind is the kind of resource an Audience refers to.
+type AudienceKind int
+
+const (
+	// AudienceUnknown is the kind of invalid audiences.
+	AudienceUnknown AudienceKind = iota
+	// AudienceAppEngine is the kind of App Engine audiences.
+	AudienceAppEngine
+	// AudienceBackendService is the kind of global backend service audiences.
+	AudienceBackendService
+	// AudienceRegionalBackendService is the kind of regional backend service audiences.
+	AudienceRegionalBackendService
+	// AudienceCloudRunService is the kind of Cloud Run service audiences.
+	AudienceCloudRunService
+)
+
+// String returns a human-readable name for the AudienceKind.
+func (k AudienceKind) String() string {
+	switch k {
+	case AudienceAppEngine:
+		return "App Engine"
+	case AudienceBackendService:
+		return "backend service"
+	case AudienceRegionalBackendService:
+		return "regional backend service"
+	case AudienceCloudRunService:
+		return "Cloud Run service"
+	}
+	return "unknown"
+}
+
+// audienceParts holds the parsed components of an Audience.
+type audienceParts struct {
+	kind          AudienceKind
+	projectNumber string
+	projectID     string
+	region        string
+	serviceID     string
+}
+
 // NewAudience returns an Audience from a string.
 func NewAudience(u string) *Audience {
 	aud := Audience(u)
@@ -20,24 +62,105 @@ func NewAudience(u string) *Audience {
 
 // Validate performs error checking on the Audience's URL.
 func (aud *Audience) Validate() error {
+	_, err := aud.parse()
+	return err
+}
+
+// Kind returns the kind of resource the Audience refers to, or
+// AudienceUnknown if it is invalid.
+func (aud *Audience) Kind() AudienceKind {
+	p, _ := aud.parse()
+	return p.kind
+}
+
+// ProjectNumber returns the project number in the Audience.
+func (aud *Audience) ProjectNumber() string {
+	p, _ := aud.parse()
+	return p.projectNumber
+}
+
+// ProjectID returns the project ID in the Audience.
+// Only App Engine audiences include it, so it is empty for other kinds.
+func (aud *Audience) ProjectID() string {
+	p, _ := aud.parse()
+	return p.projectID
+}
+
+// Region returns the region of regional backend service and Cloud Run
+// audiences, or an empty string for other kinds.
+func (aud *Audience) Region() string {
+	p, _ := aud.parse()
+	return p.region
+}
+
+// ServiceID returns the backend service ID, Cloud Run service name or, for
+// App Engine, the project ID in the Audience.
+func (aud *Audience) ServiceID() string {
+	p, _ := aud.parse()
+	return p.serviceID
+}
+
+func (aud *Audience) parse() (audienceParts, error) {
+	var parts audienceParts
 	rawAudience := string(*aud)
 	p := strings.SplitN(rawAudience, "/", 4)
 	if len(p) != 4 {
-		return fmt.Errorf("audience %q must follow the format \"/projects/PROJECT_NUMBER/SERVICE_DETAILS\"", rawAudience)
+		return parts, fmt.Errorf("audience %q must follow the format \"/projects/PROJECT_NUMBER/SERVICE_DETAILS\"", rawAudience)
 	}
 	if p[0] != "" {
-		return fmt.Errorf("audience %q should start with a slash", rawAudience)
+		return parts, fmt.Errorf("audience %q should start with a slash", rawAudience)
 	}
 	if p[1] != "projects" {
-		return fmt.Errorf("expecting \"projects\" but got %q in audience %q", p[1], rawAudience)
+		return parts, fmt.Errorf("expecting \"projects\" but got %q in audience %q", p[1], rawAudience)
 	}
-	if projectNumber := p[2]; len(projectNumber) == 0 {
-		return fmt.Errorf("audience %q must have a non-empty project number", rawAudience)
+	projectNumber := p[2]
+	if len(projectNumber) == 0 {
+		return parts, fmt.Errorf("audience %q must have a non-empty project number", rawAudience)
+	}
+	if !isNumeric(projectNumber) {
+		return parts, fmt.Errorf("audience %q must have a numeric project number", rawAudience)
+	}
+	serviceDetails := p[3]
+	if len(serviceDetails) == 0 {
+		return parts, fmt.Errorf("audience %q is missing service details", rawAudience)
+	}
+	parts.projectNumber = projectNumber
+	s := strings.Split(serviceDetails, "/")
+	switch {
+	case len(s) == 2 && s[0] == "apps" && len(s[1]) != 0:
+		parts.kind = AudienceAppEngine
+		parts.projectID = s[1]
+		parts.serviceID = s[1]
+	case len(s) == 3 && s[0] == "global" && s[1] == "backendServices" && isNumeric(s[2]):
+		parts.kind = AudienceBackendService
+		parts.serviceID = s[2]
+	case len(s) == 4 && s[0] == "locations" && s[1] == "global" && s[2] == "backendServices" && isNumeric(s[3]):
+		parts.kind = AudienceBackendService
+		parts.serviceID = s[3]
+	case len(s) == 4 && s[0] == "locations" && len(s[1]) != 0 && s[2] == "backendServices" && isNumeric(s[3]):
+		parts.kind = AudienceRegionalBackendService
+		parts.region = s[1]
+		parts.serviceID = s[3]
+	case len(s) == 4 && s[0] == "locations" && len(s[1]) != 0 && s[2] == "services" && len(s[3]) != 0:
+		parts.kind = AudienceCloudRunService
+		parts.region = s[1]
+		parts.serviceID = s[3]
+	default:
+		return audienceParts{}, fmt.Errorf("audience %q has unsupported service details %q", rawAudience, serviceDetails)
+	}
+	return parts, nil
+}
+
+func isNumeric(s string) bool {
+	if len(s) == 0 {
+		return false
 	}
-	if serviceDetails := p[3]; len(serviceDetails) == 0 {
-		return fmt.Errorf("audience %q is missing service details", rawAudience)
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
 	}
-	return nil
+	return true
 }
 
 // ParseAudience parses an Audience from a string.
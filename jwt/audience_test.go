@@ -36,6 +36,31 @@ func TestAudiences(t *testing.T) {
 			aud:  "/projects/1234/",
 			err:  fmt.Errorf("audience \"/projects/1234/\" is missing service details"),
 		},
+		{
+			name: "global: non-numeric service id",
+			aud:  "/projects/1234/global/backendServices/abc",
+			err:  fmt.Errorf("audience \"/projects/1234/global/backendServices/abc\" has unsupported service details \"global/backendServices/abc\""),
+		},
+		{
+			name: "regional: valid",
+			aud:  "/projects/1234/locations/us-central1/backendServices/5678",
+			err:  nil,
+		},
+		{
+			name: "cloud run: valid",
+			aud:  "/projects/1234/locations/us-central1/services/my-service",
+			err:  nil,
+		},
+		{
+			name: "misc: non-numeric project number",
+			aud:  "/projects/my-project/apps/fake-project-id",
+			err:  fmt.Errorf("audience \"/projects/my-project/apps/fake-project-id\" must have a numeric project number"),
+		},
+		{
+			name: "misc: unsupported service details",
+			aud:  "/projects/1234/aaaa",
+			err:  fmt.Errorf("audience \"/projects/1234/aaaa\" has unsupported service details \"aaaa\""),
+		},
 	}
 
 	for _, tc := range testTable {
@@ -59,3 +84,74 @@ func TestAudiences(t *testing.T) {
 		})
 	}
 }
+
+func TestAudienceParts(t *testing.T) {
+	testTable := []struct {
+		aud           string
+		kind          AudienceKind
+		projectNumber string
+		projectID     string
+		region        string
+		serviceID     string
+	}{
+		{
+			aud:           "/projects/1234/apps/fake-project-id",
+			kind:          AudienceAppEngine,
+			projectNumber: "1234",
+			projectID:     "fake-project-id",
+			serviceID:     "fake-project-id",
+		},
+		{
+			aud:           "/projects/1234/global/backendServices/5678",
+			kind:          AudienceBackendService,
+			projectNumber: "1234",
+			serviceID:     "5678",
+		},
+		{
+			aud:           "/projects/1234/locations/global/backendServices/5678",
+			kind:          AudienceBackendService,
+			projectNumber: "1234",
+			serviceID:     "5678",
+		},
+		{
+			aud:           "/projects/1234/locations/asia-northeast1/backendServices/5678",
+			kind:          AudienceRegionalBackendService,
+			projectNumber: "1234",
+			region:        "asia-northeast1",
+			serviceID:     "5678",
+		},
+		{
+			aud:           "/projects/1234/locations/asia-northeast1/services/my-service",
+			kind:          AudienceCloudRunService,
+			projectNumber: "1234",
+			region:        "asia-northeast1",
+			serviceID:     "my-service",
+		},
+		{
+			aud:  "/projects/1234/",
+			kind: AudienceUnknown,
+		},
+	}
+
+	for _, tc := range testTable {
+		tc := tc
+		t.Run(tc.aud, func(t *testing.T) {
+			aud := NewAudience(tc.aud)
+			if aud.Kind() != tc.kind {
+				t.Errorf("unexpected kind: %v", aud.Kind())
+			}
+			if aud.ProjectNumber() != tc.projectNumber {
+				t.Errorf("unexpected project number: %q", aud.ProjectNumber())
+			}
+			if aud.ProjectID() != tc.projectID {
+				t.Errorf("unexpected project ID: %q", aud.ProjectID())
+			}
+			if aud.Region() != tc.region {
+				t.Errorf("unexpected region: %q", aud.Region())
+			}
+			if aud.ServiceID() != tc.serviceID {
+				t.Errorf("unexpected service ID: %q", aud.ServiceID())
+			}
+		})
+	}
+}
@@ -1,7 +1,8 @@
 package jwt
 
 import (
-	"fmt"
+	"encoding/json"
+	"time"
 
 	jwt "github.com/golang-jwt/jwt/v4"
 )
@@ -10,24 +11,121 @@ import (
 type Claims struct {
 	jwt.StandardClaims
 	Email string `json:"email,omitempty"`
+	// EmailVerified is set by Google OIDC ID tokens.
+	EmailVerified bool `json:"email_verified,omitempty"`
+	// AuthorizedParty is the azp claim of Google OIDC ID tokens.
+	AuthorizedParty string `json:"azp,omitempty"`
+	// HostedDomain is the hosted domain (hd claim) of the user, if any.
+	HostedDomain string `json:"hd,omitempty"`
+	// Google holds the Google specific claims, if any.
+	Google *GoogleClaims `json:"google,omitempty"`
+	// GCIP holds the Identity Platform claims for external identities, if any.
+	GCIP *GCIPClaims `json:"gcip,omitempty"`
 
-	cfg *Config
+	raw     map[string]interface{}
+	cfg     *Config
+	profile *Profile
+}
+
+// GoogleClaims represents the google claim set by Cloud IAP.
+type GoogleClaims struct {
+	// AccessLevels are the Access Context Manager access levels satisfied by
+	// the request, eg: accessPolicies/POLICY_ID/accessLevels/LEVEL_NAME.
+	AccessLevels []string `json:"access_levels,omitempty"`
+}
+
+// GCIPClaims represents the gcip claim set by Cloud IAP when users are
+// authenticated with Identity Platform.
+type GCIPClaims struct {
+	Subject       string        `json:"sub,omitempty"`
+	UserID        string        `json:"user_id,omitempty"`
+	Email         string        `json:"email,omitempty"`
+	EmailVerified bool          `json:"email_verified,omitempty"`
+	Name          string        `json:"name,omitempty"`
+	Picture       string        `json:"picture,omitempty"`
+	AuthTime      int64         `json:"auth_time,omitempty"`
+	Firebase      *GCIPFirebase `json:"firebase,omitempty"`
+}
+
+// GCIPFirebase represents the firebase claim inside GCIPClaims.
+type GCIPFirebase struct {
+	Tenant         string                 `json:"tenant,omitempty"`
+	SignInProvider string                 `json:"sign_in_provider,omitempty"`
+	Identities     map[string]interface{} `json:"identities,omitempty"`
+}
+
+// UnmarshalJSON decodes the Claims and keeps a copy of all raw claims.
+func (c *Claims) UnmarshalJSON(b []byte) error {
+	type claims Claims
+	if err := json.Unmarshal(b, (*claims)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &c.raw)
+}
+
+// Raw returns all the claims in the token, including those without a
+// dedicated field in Claims.
+func (c *Claims) Raw() map[string]interface{} {
+	return c.raw
+}
+
+// Profile returns the Profile the token was verified with.
+func (c *Claims) Profile() *Profile {
+	if c.profile == nil {
+		return c.cfg.profiles()[0]
+	}
+	return c.profile
+}
+
+// AccessLevels returns the access levels in the google claim, if any.
+func (c *Claims) AccessLevels() []string {
+	if c.Google == nil {
+		return nil
+	}
+	return c.Google.AccessLevels
 }
 
 // Valid validates the Claims.
 func (c Claims) Valid() error {
-	if err := (c.StandardClaims).Valid(); err != nil {
+	if err := c.validTime(); err != nil {
 		return err
 	}
-	if c.Issuer != issuerClaim {
-		return fmt.Errorf("Invalid issuer: %q", c.Issuer)
+	profile := c.Profile()
+	if !profile.hasIssuer(c.Issuer) {
+		return newVerificationError(ErrInvalidIssuer, "%q", c.Issuer)
+	}
+	if profile.RequireVerifiedEmail && c.Email != "" && !c.EmailVerified {
+		return newVerificationError(ErrUnverifiedEmail, "%q", c.Email)
+	}
+	return profile.validAudience(c.Audience)
+}
+
+// validTime checks the exp, iat and nbf claims against the configured clock,
+// tolerating up to cfg.Leeway of clock skew, and enforces cfg.MaxTokenAge.
+func (c Claims) validTime() error {
+	now := c.cfg.now()
+	if c.ExpiresAt != 0 {
+		if exp := time.Unix(c.ExpiresAt, 0); now.After(exp.Add(c.cfg.Leeway)) {
+			return newVerificationError(ErrTokenExpired, "expired at %v", exp.UTC())
+		}
+	}
+	if c.IssuedAt != 0 {
+		if iat := time.Unix(c.IssuedAt, 0); now.Before(iat.Add(-c.cfg.Leeway)) {
+			return newVerificationError(ErrTokenNotValidYet, "used before issued at %v", iat.UTC())
+		}
 	}
-	aud, err := ParseAudience(c.Audience)
-	if err != nil {
-		return fmt.Errorf("Invalid audience %q: %v", c.Audience, err)
+	if c.NotBefore != 0 {
+		if nbf := time.Unix(c.NotBefore, 0); now.Before(nbf.Add(-c.cfg.Leeway)) {
+			return newVerificationError(ErrTokenNotValidYet, "not valid before %v", nbf.UTC())
+		}
 	}
-	if !c.cfg.matchesAudience(aud) {
-		return fmt.Errorf("Unexpected audience: %q", c.Audience)
+	if c.cfg.MaxTokenAge > 0 {
+		if c.IssuedAt == 0 {
+			return newVerificationError(ErrTokenTooOld, "missing iat claim")
+		}
+		if iat := time.Unix(c.IssuedAt, 0); now.After(iat.Add(c.cfg.MaxTokenAge + c.cfg.Leeway)) {
+			return newVerificationError(ErrTokenTooOld, "issued at %v", iat.UTC())
+		}
 	}
 	return nil
 }
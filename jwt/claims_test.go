@@ -0,0 +1,140 @@
+package jwt
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func TestClaimsValidTime(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	at := func(d time.Duration) int64 {
+		return now.Add(d).Unix()
+	}
+
+	testTable := []struct {
+		name   string
+		leeway time.Duration
+		maxAge time.Duration
+		claims jwt.StandardClaims
+		err    error
+	}{
+		{
+			name:   "valid",
+			claims: jwt.StandardClaims{ExpiresAt: at(time.Minute), IssuedAt: at(-time.Minute)},
+		},
+		{
+			name:   "expired",
+			claims: jwt.StandardClaims{ExpiresAt: at(-time.Second), IssuedAt: at(-time.Hour)},
+			err:    ErrTokenExpired,
+		},
+		{
+			name:   "expired within leeway",
+			leeway: 5 * time.Second,
+			claims: jwt.StandardClaims{ExpiresAt: at(-time.Second), IssuedAt: at(-time.Hour)},
+		},
+		{
+			name:   "issued in the future",
+			claims: jwt.StandardClaims{ExpiresAt: at(time.Hour), IssuedAt: at(2 * time.Second)},
+			err:    ErrTokenNotValidYet,
+		},
+		{
+			name:   "issued in the future within leeway",
+			leeway: 5 * time.Second,
+			claims: jwt.StandardClaims{ExpiresAt: at(time.Hour), IssuedAt: at(2 * time.Second)},
+		},
+		{
+			name:   "not before in the future",
+			leeway: 5 * time.Second,
+			claims: jwt.StandardClaims{ExpiresAt: at(time.Hour), NotBefore: at(10 * time.Second)},
+			err:    ErrTokenNotValidYet,
+		},
+		{
+			name:   "younger than max age",
+			maxAge: 5 * time.Minute,
+			claims: jwt.StandardClaims{ExpiresAt: at(time.Hour), IssuedAt: at(-4 * time.Minute)},
+		},
+		{
+			name:   "older than max age",
+			maxAge: 5 * time.Minute,
+			claims: jwt.StandardClaims{ExpiresAt: at(time.Hour), IssuedAt: at(-6 * time.Minute)},
+			err:    ErrTokenTooOld,
+		},
+		{
+			name:   "max age without iat",
+			maxAge: 5 * time.Minute,
+			claims: jwt.StandardClaims{ExpiresAt: at(time.Hour)},
+			err:    ErrTokenTooOld,
+		},
+	}
+
+	for _, tc := range testTable {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.claims.Issuer = issuerClaim
+			tc.claims.Audience = testAudience
+			claims := Claims{
+				StandardClaims: tc.claims,
+				cfg: &Config{
+					MatchAudiences: regexp.MustCompile(".*"),
+					Now:            func() time.Time { return now },
+					Leeway:         tc.leeway,
+					MaxTokenAge:    tc.maxAge,
+				},
+			}
+			err := claims.Valid()
+			switch {
+			case tc.err == nil && err != nil:
+				t.Error("expected no error, got error:", err)
+			case tc.err != nil && !errors.Is(err, tc.err):
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestClaimsUnmarshalJSON(t *testing.T) {
+	payload := `{
+		"aud": "/projects/1/global/backendServices/1",
+		"email": "user@example.com",
+		"hd": "example.com",
+		"google": {"access_levels": ["accessPolicies/1/accessLevels/corp"]},
+		"gcip": {
+			"sub": "gcip-user",
+			"email": "user@external.example",
+			"email_verified": true,
+			"firebase": {"tenant": "tenant-1", "sign_in_provider": "password"}
+		},
+		"custom": "value"
+	}`
+	cfg := &Config{}
+	claims := &Claims{cfg: cfg}
+	if err := json.Unmarshal([]byte(payload), claims); err != nil {
+		t.Fatalf("Failed to unmarshal claims: %+v", err)
+	}
+	if claims.cfg != cfg {
+		t.Error("cfg was not preserved")
+	}
+	if claims.Email != "user@example.com" || claims.Audience != testAudience {
+		t.Errorf("unexpected standard claims: %+v", claims)
+	}
+	if claims.HostedDomain != "example.com" {
+		t.Errorf("unexpected hd: %q", claims.HostedDomain)
+	}
+	if levels := claims.AccessLevels(); len(levels) != 1 || levels[0] != "accessPolicies/1/accessLevels/corp" {
+		t.Errorf("unexpected access levels: %v", levels)
+	}
+	if claims.GCIP == nil || claims.GCIP.Subject != "gcip-user" || !claims.GCIP.EmailVerified {
+		t.Fatalf("unexpected gcip claims: %+v", claims.GCIP)
+	}
+	if claims.GCIP.Firebase == nil || claims.GCIP.Firebase.Tenant != "tenant-1" || claims.GCIP.Firebase.SignInProvider != "password" {
+		t.Errorf("unexpected gcip firebase claims: %+v", claims.GCIP.Firebase)
+	}
+	if v := claims.Raw()["custom"]; v != "value" {
+		t.Errorf("unexpected raw claim: %v", v)
+	}
+}
@@ -3,26 +3,63 @@ package jwt
 import (
 	"errors"
 	"regexp"
+	"time"
 )
 
 // Config specifies the parameters for which to perform validation of JWT
 // tokens in requests against.
 type Config struct {
+	// PublicKeys and MatchAudiences define the Cloud IAP profile used when
+	// Profiles is empty.
 	PublicKeys     *KeyStore
 	MatchAudiences *regexp.Regexp
+	// Profiles are the accepted token issuers, in order of precedence when
+	// looking for tokens in requests. If empty, only Cloud IAP tokens are
+	// accepted, according to PublicKeys and MatchAudiences.
+	Profiles []*Profile
+	// TokenSources, if not empty, are where tokens are looked for in
+	// requests, instead of the TokenSource of each Profile. The token is
+	// taken from the first source that has one, and requests with different
+	// tokens in several sources are rejected.
+	TokenSources []TokenSource
+	// Now returns the current time used to check the exp, iat and nbf
+	// claims. If nil, time.Now is used.
+	Now func() time.Time
+	// Leeway is the clock skew tolerated when checking the exp, iat and nbf
+	// claims.
+	Leeway time.Duration
+	// MaxTokenAge, if non-zero, rejects tokens issued (iat claim) longer ago
+	// than this, regardless of their expiration time.
+	MaxTokenAge time.Duration
 }
 
 // Validate validates the Configuration.
 func (cfg *Config) Validate() error {
-	if cfg.MatchAudiences == nil {
-		return errors.New("No audiences to match defined")
+	for _, p := range cfg.profiles() {
+		if err := p.Validate(); err != nil {
+			return err
+		}
 	}
-	if cfg.PublicKeys.IsEmpty() {
-		return errors.New("No public keys defined")
+	if cfg.Leeway < 0 {
+		return errors.New("Leeway must not be negative")
+	}
+	if cfg.MaxTokenAge < 0 {
+		return errors.New("Max token age must not be negative")
 	}
 	return nil
 }
 
-func (cfg *Config) matchesAudience(aud *Audience) bool {
-	return cfg.MatchAudiences.MatchString((string)(*aud))
+// profiles returns the Profiles, or the default Cloud IAP profile.
+func (cfg *Config) profiles() []*Profile {
+	if len(cfg.Profiles) != 0 {
+		return cfg.Profiles
+	}
+	return []*Profile{NewIAPProfile(cfg.PublicKeys, cfg.MatchAudiences)}
+}
+
+func (cfg *Config) now() time.Time {
+	if cfg.Now == nil {
+		return time.Now()
+	}
+	return cfg.Now()
 }
@@ -0,0 +1,72 @@
+package jwt
+
+import (
+	"errors"
+	"fmt"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// Errors returned (wrapped in a *VerificationError) when a token fails
+// verification. Use errors.Is to check for them.
+var (
+	ErrMissingToken      = errors.New("token was not found")
+	ErrConflictingTokens = errors.New("conflicting tokens")
+	ErrMalformedToken    = errors.New("malformed token")
+	ErrInvalidAlgorithm  = errors.New("invalid algorithm")
+	ErrUnknownKeyID      = errors.New("no public key for key ID")
+	ErrInvalidSignature  = errors.New("invalid signature")
+	ErrTokenExpired      = errors.New("token is expired")
+	ErrTokenNotValidYet  = errors.New("token is not valid yet")
+	ErrTokenTooOld       = errors.New("token is too old")
+	ErrInvalidIssuer     = errors.New("invalid issuer")
+	ErrInvalidAudience   = errors.New("invalid audience")
+	ErrUnverifiedEmail   = errors.New("email is not verified")
+)
+
+// VerificationError describes why a token failed verification.
+type VerificationError struct {
+	// Err is one of the Err* errors defined in this package.
+	Err error
+	// Detail gives additional information about the failure, if any.
+	Detail string
+}
+
+func newVerificationError(err error, format string, args ...interface{}) *VerificationError {
+	return &VerificationError{Err: err, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Error implements the error interface.
+func (e *VerificationError) Error() string {
+	if len(e.Detail) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.Err, e.Detail)
+}
+
+// Unwrap returns the underlying Err* error.
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+// verificationError converts errors returned by the jwt parser into a
+// *VerificationError.
+func verificationError(err error) error {
+	var ve *VerificationError
+	if errors.As(err, &ve) {
+		return ve
+	}
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return newVerificationError(ErrMalformedToken, "%v", err)
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return newVerificationError(ErrInvalidSignature, "%v", err)
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return newVerificationError(ErrTokenExpired, "%v", err)
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return newVerificationError(ErrTokenNotValidYet, "%v", err)
+	case errors.Is(err, jwt.ErrTokenUnverifiable):
+		return newVerificationError(ErrInvalidAlgorithm, "%v", err)
+	}
+	return newVerificationError(ErrMalformedToken, "%v", err)
+}
@@ -0,0 +1,135 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// jwks represents a JSON Web Key Set as defined by RFC 7517.
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwk represents a single JSON Web Key.
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// DecodeJWKS decodes all ECDSA public keys from the JSON Web Key Set in the
+// given Reader, such as the one published by Google at
+// https://www.gstatic.com/iap/verify/public_key-jwk.
+// Keys that are not meant for signatures or are not ECDSA keys are skipped.
+func DecodeJWKS(r io.Reader) (map[string]*ecdsa.PublicKey, error) {
+	var set jwks
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys, err := set.publicKeys()
+	if err != nil {
+		return nil, err
+	}
+	ecKeys := make(map[string]*ecdsa.PublicKey)
+	for k, v := range keys {
+		if key, ok := v.(*ecdsa.PublicKey); ok {
+			ecKeys[k] = key
+		}
+	}
+	return ecKeys, nil
+}
+
+// publicKeys returns the ECDSA and RSA signature keys in the set.
+func (set *jwks) publicKeys() (map[string]crypto.PublicKey, error) {
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.KeyType {
+		case "EC":
+			key, err = k.ecdsaKey()
+		case "RSA":
+			key, err = k.rsaKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JWK %q: %w", k.KeyID, err)
+		}
+		keys[k.KeyID] = key
+	}
+	return keys, nil
+}
+
+func (k *jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil || len(n) == 0 {
+		return nil, fmt.Errorf("invalid modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if exponent.Int64() < 3 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(exponent.Int64()),
+	}, nil
+}
+
+func (k *jwk) ecdsaKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	var ecdhCurve ecdh.Curve
+	switch k.Curve {
+	case "P-256":
+		curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+	case "P-384":
+		curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+	case "P-521":
+		curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x coordinate: %w", err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y coordinate: %w", err)
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if len(x) != size || len(y) != size {
+		return nil, fmt.Errorf("invalid coordinate length for curve %q", k.Curve)
+	}
+	// Make sure the point is on the curve.
+	point := append(append([]byte{4}, x...), y...)
+	if _, err := ecdhCurve.NewPublicKey(point); err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
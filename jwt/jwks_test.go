@@ -0,0 +1,75 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func jwkJSON(t testing.TB, kid string, key *ecdsa.PublicKey) string {
+	t.Helper()
+	b, err := json.Marshal(jwk{
+		KeyType:   "EC",
+		KeyID:     kid,
+		Use:       "sig",
+		Algorithm: "ES256",
+		Curve:     "P-256",
+		X:         base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:         base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal JWK: %+v", err)
+	}
+	return string(b)
+}
+
+func TestDecodeJWKS(t *testing.T) {
+	key, _ := newTestKey(t)
+	set := fmt.Sprintf(`{"keys": [%s, {"kty": "RSA", "kid": "rsa", "n": "AQAB", "e": "AQAB"}]}`, jwkJSON(t, "key1", &key.PublicKey))
+
+	keys, err := DecodeJWKS(strings.NewReader(set))
+	if err != nil {
+		t.Fatalf("Failed to decode JWKS: %+v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(keys))
+	}
+	if !keys["key1"].Equal(&key.PublicKey) {
+		t.Error("decoded key does not match")
+	}
+
+	t.Run("invalid point", func(t *testing.T) {
+		zero := base64.RawURLEncoding.EncodeToString(make([]byte, 32))
+		set := fmt.Sprintf(`{"keys": [{"kty": "EC", "kid": "bad", "crv": "P-256", "x": %q, "y": %q}]}`, zero, zero)
+		if _, err := DecodeJWKS(strings.NewReader(set)); err == nil {
+			t.Error("expected error, got no error")
+		}
+	})
+}
+
+func TestDecodePublicKeysJWKS(t *testing.T) {
+	key, _ := newTestKey(t)
+	set := fmt.Sprintf(`{"keys": [%s]}`, jwkJSON(t, "key1", &key.PublicKey))
+
+	keys, err := DecodePublicKeys(strings.NewReader(set))
+	if err != nil {
+		t.Fatalf("Failed to decode public keys: %+v", err)
+	}
+	cfg := newTestConfig(t, keys)
+	token := signTestToken(t, jwt.MapClaims{
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+		"aud": testAudience,
+		"iss": issuerClaim,
+	}, "key1", key)
+	if _, err := NewVerifier(cfg).Verify(context.Background(), token); err != nil {
+		t.Errorf("expected no error, got error: %v", err)
+	}
+}
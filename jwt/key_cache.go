@@ -0,0 +1,95 @@
+package jwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SetCachePath sets the path of a file to which keys are written after each
+// successful UpdateKeys, so that they can be loaded with LoadCache when the
+// KeySource is unavailable.
+func (ks *KeyStore) SetCachePath(path string) {
+	ks.lock.Lock()
+	ks.cachePath = path
+	ks.lock.Unlock()
+}
+
+// LoadCache loads the keys from the cache file set with SetCachePath, and
+// returns when the file was written.
+func (ks *KeyStore) LoadCache() (time.Time, error) {
+	ks.lock.RLock()
+	path := ks.cachePath
+	ks.lock.RUnlock()
+	if len(path) == 0 {
+		return time.Time{}, fmt.Errorf("no public keys cache file defined")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("load public keys cache: %w", err)
+	}
+	keys, err := loadPublicKeysFromFile(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("load public keys cache: %w", err)
+	}
+	ks.replaceKeys(keys, time.Time{})
+	ks.lock.Lock()
+	ks.cachedAt = info.ModTime()
+	ks.lock.Unlock()
+	return info.ModTime(), nil
+}
+
+// CachedAt returns when the cache file the keys were loaded from by
+// LoadCache was written, or the zero time if the keys were fetched from the
+// KeySource since (or never loaded from the cache).
+func (ks *KeyStore) CachedAt() time.Time {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	return ks.cachedAt
+}
+
+// writeCache writes the keys to the cache file, if any.
+func (ks *KeyStore) writeCache(keys map[string]PublicKey) {
+	ks.lock.RLock()
+	path := ks.cachePath
+	ks.lock.RUnlock()
+	if len(path) == 0 {
+		return
+	}
+	if err := writePublicKeysToFile(path, keys); err != nil {
+		log.Printf("Failed to write public keys cache: %+v", err)
+	}
+}
+
+// writePublicKeysToFile atomically writes the keys to filePath, in the same
+// format as https://www.gstatic.com/iap/verify/public_key.
+func writePublicKeysToFile(filePath string, keys map[string]PublicKey) error {
+	skeys := make(map[string]string, len(keys))
+	for k, v := range keys {
+		skeys[k] = string(v)
+	}
+	b, err := json.Marshal(skeys)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filePath)
+}
@@ -0,0 +1,59 @@
+package jwt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyStoreCache(t *testing.T) {
+	_, pub := newTestKey(t)
+	body, err := json.Marshal(map[string]string{"key1": string(pub)})
+	if err != nil {
+		t.Fatalf("Failed to marshal json: %+v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(body); err != nil {
+			t.Errorf("Failed to write response: %+v", err)
+		}
+	}))
+	defer srv.Close()
+	cachePath := filepath.Join(t.TempDir(), "keys.json")
+
+	ks := NewKeyStore("", srv.URL)
+	ks.SetCachePath(cachePath)
+	if err := ks.UpdateKeys(); err != nil {
+		t.Fatalf("Failed to update keys: %+v", err)
+	}
+
+	srv.Close()
+	ks = NewKeyStore("", srv.URL)
+	ks.SetCachePath(cachePath)
+	if err := ks.UpdateKeys(); err == nil {
+		t.Fatal("expected error for unreachable key URL, got no error")
+	}
+	cachedAt, err := ks.LoadCache()
+	if err != nil {
+		t.Fatalf("Failed to load cache: %+v", err)
+	}
+	if age := time.Since(cachedAt); age < 0 || age > time.Minute {
+		t.Errorf("unexpected cache time: %v", cachedAt)
+	}
+	if got := ks.CachedAt(); !got.Equal(cachedAt) {
+		t.Errorf("unexpected CachedAt: %v, want %v", got, cachedAt)
+	}
+	if k, err := ks.GetECDSAKey("key1"); k == nil || err != nil {
+		t.Errorf("expected key from cache, got %v (%v)", k, err)
+	}
+
+	t.Run("missing cache", func(t *testing.T) {
+		ks := NewKeyStore("", srv.URL)
+		ks.SetCachePath(filepath.Join(t.TempDir(), "missing.json"))
+		if _, err := ks.LoadCache(); err == nil {
+			t.Error("expected error, got no error")
+		}
+	})
+}
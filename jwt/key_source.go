@@ -0,0 +1,158 @@
+package jwt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// KeySet is a set of public keys provided by a KeySource.
+type KeySet struct {
+	// Keys maps key IDs to public keys.
+	Keys map[string]PublicKey
+	// Expires is when the keys should be fetched again, or zero if unknown.
+	Expires time.Time
+}
+
+// KeySource provides the public keys of a KeyStore.
+// Implementations must be safe for concurrent use.
+type KeySource interface {
+	// FetchKeys returns the current set of public keys.
+	FetchKeys(ctx context.Context) (*KeySet, error)
+}
+
+// FileKeySource is a KeySource that reads public keys from a file, in any
+// of the formats supported by DecodePublicKeys.
+type FileKeySource struct {
+	Path string
+}
+
+// FetchKeys implements the KeySource interface.
+func (s *FileKeySource) FetchKeys(ctx context.Context) (*KeySet, error) {
+	keys, err := loadPublicKeysFromFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &KeySet{Keys: keys}, nil
+}
+
+// URLKeySource is a KeySource that downloads public keys from a URL, in any
+// of the formats supported by DecodePublicKeys.
+// Keys are fetched again with conditional requests (If-None-Match and
+// If-Modified-Since), so unchanged keys are not downloaded again.
+type URLKeySource struct {
+	URL string
+	// Client is the HTTP Client used to fetch keys. If nil, HTTPClient is used.
+	Client *http.Client
+
+	lock         sync.Mutex
+	keys         map[string]PublicKey
+	etag         string
+	lastModified string
+}
+
+// FetchKeys implements the KeySource interface.
+func (s *URLKeySource) FetchKeys(ctx context.Context) (*KeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.keys != nil {
+		if len(s.etag) != 0 {
+			req.Header.Set("If-None-Match", s.etag)
+		}
+		if len(s.lastModified) != 0 {
+			req.Header.Set("If-Modified-Since", s.lastModified)
+		}
+	}
+	client := s.Client
+	if client == nil {
+		client = HTTPClient
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	switch {
+	case r.StatusCode == http.StatusNotModified && s.keys != nil:
+	case r.StatusCode == http.StatusOK:
+		keys, err := DecodePublicKeys(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = keys
+		s.etag = r.Header.Get("ETag")
+		s.lastModified = r.Header.Get("Last-Modified")
+	default:
+		return nil, fmt.Errorf("unexpected response status %q from %s", r.Status, s.URL)
+	}
+	keys := make(map[string]PublicKey, len(s.keys))
+	for k, v := range s.keys {
+		keys[k] = v
+	}
+	return &KeySet{Keys: keys, Expires: cacheExpiry(r.Header, time.Now())}, nil
+}
+
+// StaticKeySource is a KeySource that always provides the same public keys.
+type StaticKeySource map[string]PublicKey
+
+// FetchKeys implements the KeySource interface.
+func (s StaticKeySource) FetchKeys(ctx context.Context) (*KeySet, error) {
+	keys := make(map[string]PublicKey, len(s))
+	for k, v := range s {
+		keys[k] = v
+	}
+	return &KeySet{Keys: keys}, nil
+}
+
+// MergedKeySource is a KeySource that provides the keys of all its sources.
+// It fails if any of its sources fails, so that keys are never dropped
+// because of a temporary error.
+type MergedKeySource []KeySource
+
+// FetchKeys implements the KeySource interface.
+func (s MergedKeySource) FetchKeys(ctx context.Context) (*KeySet, error) {
+	if len(s) == 0 {
+		return nil, errors.New("no key sources defined")
+	}
+	merged := &KeySet{Keys: make(map[string]PublicKey)}
+	for i, src := range s {
+		set, err := src.FetchKeys(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("key source #%d: %w", i+1, err)
+		}
+		for k, v := range set.Keys {
+			merged.Keys[k] = v
+		}
+		if !set.Expires.IsZero() && (merged.Expires.IsZero() || set.Expires.Before(merged.Expires)) {
+			merged.Expires = set.Expires
+		}
+	}
+	return merged, nil
+}
+
+// FailoverKeySource is a KeySource that provides the keys of the first of
+// its sources that does not fail.
+type FailoverKeySource []KeySource
+
+// FetchKeys implements the KeySource interface.
+func (s FailoverKeySource) FetchKeys(ctx context.Context) (*KeySet, error) {
+	if len(s) == 0 {
+		return nil, errors.New("no key sources defined")
+	}
+	var errs []error
+	for i, src := range s {
+		set, err := src.FetchKeys(ctx)
+		if err == nil {
+			return set, nil
+		}
+		errs = append(errs, fmt.Errorf("key source #%d: %w", i+1, err))
+	}
+	return nil, errors.Join(errs...)
+}
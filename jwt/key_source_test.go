@@ -0,0 +1,134 @@
+package jwt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type failingKeySource struct{}
+
+func (failingKeySource) FetchKeys(ctx context.Context) (*KeySet, error) {
+	return nil, errors.New("unavailable")
+}
+
+type expiringKeySource struct {
+	StaticKeySource
+	expires time.Time
+}
+
+func (s expiringKeySource) FetchKeys(ctx context.Context) (*KeySet, error) {
+	set, err := s.StaticKeySource.FetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	set.Expires = s.expires
+	return set, nil
+}
+
+func TestMergedKeySource(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	src := MergedKeySource{
+		StaticKeySource{"key1": []byte("testkey1")},
+		expiringKeySource{StaticKeySource{"key2": []byte("testkey2")}, expires},
+		expiringKeySource{StaticKeySource{"key3": []byte("testkey3")}, expires.Add(time.Hour)},
+	}
+	set, err := src.FetchKeys(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to fetch keys: %+v", err)
+	}
+	if len(set.Keys) != 3 {
+		t.Errorf("expected 3 keys, got %d", len(set.Keys))
+	}
+	if !set.Expires.Equal(expires) {
+		t.Errorf("expected earliest expiration %v, got %v", expires, set.Expires)
+	}
+
+	src = append(src, failingKeySource{})
+	if _, err := src.FetchKeys(context.Background()); err == nil {
+		t.Error("expected error, got no error")
+	}
+}
+
+func TestFailoverKeySource(t *testing.T) {
+	src := FailoverKeySource{
+		failingKeySource{},
+		StaticKeySource{"key1": []byte("testkey1")},
+		StaticKeySource{"key2": []byte("testkey2")},
+	}
+	set, err := src.FetchKeys(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to fetch keys: %+v", err)
+	}
+	if len(set.Keys) != 1 || set.Keys["key1"] == nil {
+		t.Errorf("expected keys of the first working source, got %v", set.Keys)
+	}
+
+	src = FailoverKeySource{failingKeySource{}, failingKeySource{}}
+	if _, err := src.FetchKeys(context.Background()); err == nil {
+		t.Error("expected error, got no error")
+	}
+}
+
+func TestKeyStoreWithSource(t *testing.T) {
+	key, pub := newTestKey(t)
+	ks := NewKeyStoreWithSource(StaticKeySource{"key1": pub})
+	if err := ks.UpdateKeys(); err != nil {
+		t.Fatalf("Failed to update keys: %+v", err)
+	}
+	if k, err := ks.GetECDSAKey("key1"); err != nil || !k.Equal(&key.PublicKey) {
+		t.Errorf("expected key from source, got %v (%v)", k, err)
+	}
+}
+
+func TestURLKeySourceConditionalRequests(t *testing.T) {
+	_, pub := newTestKey(t)
+	body, err := json.Marshal(map[string]string{"key1": string(pub)})
+	if err != nil {
+		t.Fatalf("Failed to marshal json: %+v", err)
+	}
+	var downloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		w.Header().Set("ETag", `"v1"`)
+		if _, err := w.Write(body); err != nil {
+			t.Errorf("Failed to write response: %+v", err)
+		}
+	}))
+	defer srv.Close()
+
+	src := &URLKeySource{URL: srv.URL, Client: srv.Client()}
+	for i := 0; i < 3; i++ {
+		set, err := src.FetchKeys(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to fetch keys: %+v", err)
+		}
+		if len(set.Keys) != 1 || set.Keys["key1"] == nil {
+			t.Errorf("unexpected keys: %v", set.Keys)
+		}
+	}
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("expected keys to be downloaded once, got %d", n)
+	}
+}
+
+func TestURLKeySourceErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	src := &URLKeySource{URL: srv.URL}
+	if _, err := src.FetchKeys(context.Background()); err == nil {
+		t.Error("expected error, got no error")
+	}
+}
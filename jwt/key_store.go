@@ -1,58 +1,243 @@
 package jwt
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"sync"
 	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultRetiredKeyGracePeriod is the default time during which keys
+	// that are no longer published are still trusted.
+	DefaultRetiredKeyGracePeriod = 10 * time.Minute
+	// DefaultUnknownKeyTTL is the default time during which a key ID that was
+	// still unknown after updating the keys does not trigger another update.
+	DefaultUnknownKeyTTL = 30 * time.Second
+	// maxUnknownKeys bounds the number of unknown key IDs remembered.
+	maxUnknownKeys = 1024
 )
 
 // KeyStore is a data structure that stores pairs of KeyId and PublicKey in a concurrent-safe manner.
+// Keys are parsed once when they are added, so that verifying tokens does
+// not need to parse them again.
 type KeyStore struct {
-	lock       sync.RWMutex
-	keys       map[string]PublicKey
-	filePath   string
-	keyURL     string
-	nextUpdate time.Time
-	updateLock sync.Mutex
+	lock        sync.RWMutex
+	keys        map[string]keyEntry
+	gracePeriod time.Duration
+	cachePath   string
+	source      KeySource
+	nextUpdate  time.Time
+	updateLock  sync.Mutex
+	updateGroup singleflight.Group
+	// unknown holds, for key IDs that were missing even after updating the
+	// keys, when they may trigger an update again.
+	unknownLock sync.Mutex
+	unknown     map[string]time.Time
+	unknownTTL  time.Duration
+	// expires is when the last fetched keys expire according to the
+	// caching headers of the response, or zero if unknown.
+	expires time.Time
+	// cachedAt is when the cache file the keys were loaded from was
+	// written, or zero if they were fetched since.
+	cachedAt time.Time
+
+	refreshLock sync.Mutex
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// keyEntry holds a PublicKey together with its parsed form.
+type keyEntry struct {
+	raw PublicKey
+	key crypto.PublicKey
+	err error
+	// retired is when the key stopped being published, or zero if it still is.
+	retired time.Time
+}
+
+func newKeyEntry(raw PublicKey) keyEntry {
+	key, err := parsePublicKey(raw)
+	return keyEntry{raw: raw, key: key, err: err}
 }
 
-// NewKeyStore creates a new KeyStore.
+// parsePublicKey parses a PEM encoded ECDSA or RSA public key.
+func parsePublicKey(raw PublicKey) (crypto.PublicKey, error) {
+	if key, err := jwt.ParseECPublicKeyFromPEM(raw); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(raw); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("key must be a PEM encoded ECDSA or RSA public key")
+}
+
+// NewKeyStore creates a new KeyStore that loads keys from filepath or, if
+// it is empty, from keyURL.
 func NewKeyStore(filepath string, keyURL string) *KeyStore {
+	if len(filepath) != 0 {
+		return NewKeyStoreWithSource(&FileKeySource{Path: filepath})
+	}
+	return NewKeyStoreWithSource(&URLKeySource{URL: keyURL})
+}
+
+// NewKeyStoreWithSource creates a new KeyStore that loads keys from source.
+func NewKeyStoreWithSource(source KeySource) *KeyStore {
 	return &KeyStore{
-		filePath: filepath,
-		keyURL:   keyURL,
-		lock:     sync.RWMutex{},
-		keys:     make(map[string]PublicKey),
+		source:      source,
+		lock:        sync.RWMutex{},
+		keys:        make(map[string]keyEntry),
+		gracePeriod: DefaultRetiredKeyGracePeriod,
+		unknown:     make(map[string]time.Time),
+		unknownTTL:  DefaultUnknownKeyTTL,
 	}
 }
 
+// SetUnknownKeyTTL sets for how long a key ID that is still unknown after
+// updating the keys is remembered, so that tokens with made-up key IDs do not
+// keep triggering updates.
+func (ks *KeyStore) SetUnknownKeyTTL(d time.Duration) {
+	ks.unknownLock.Lock()
+	ks.unknownTTL = d
+	ks.unknownLock.Unlock()
+}
+
+// SetRetiredKeyGracePeriod sets how long keys that are no longer published
+// are still trusted after UpdateKeys notices they were removed.
+func (ks *KeyStore) SetRetiredKeyGracePeriod(d time.Duration) {
+	ks.lock.Lock()
+	ks.gracePeriod = d
+	ks.lock.Unlock()
+}
+
 // AddKey adds a new key to the KeyStore.
 func (ks *KeyStore) AddKey(id string, key PublicKey) {
+	entry := newKeyEntry(key)
 	ks.lock.Lock()
-	ks.keys[id] = key
+	ks.keys[id] = entry
 	ks.lock.Unlock()
 }
 
 // GetKey retrieves a key from the KeyStore.
 func (ks *KeyStore) GetKey(id string) PublicKey {
-	ks.lock.RLock()
-	ret := ks.keys[id]
-	ks.lock.RUnlock()
-	if len(ret) == 0 {
-		ks.TryUpdateKeys()
-		ks.lock.RLock()
-		ret = ks.keys[id]
-		ks.lock.RUnlock()
+	return ks.lookup(context.Background(), id).raw
+}
+
+// GetECDSAKey retrieves the parsed ECDSA key from the KeyStore.
+// It returns nil and no error if there is no key for id.
+func (ks *KeyStore) GetECDSAKey(id string) (*ecdsa.PublicKey, error) {
+	key, err := ks.GetPublicKey(id)
+	if key == nil || err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key %q is not an ECDSA key", id)
+	}
+	return ecKey, nil
+}
+
+// GetPublicKey retrieves the parsed key (*ecdsa.PublicKey or
+// *rsa.PublicKey) from the KeyStore.
+// It returns nil and no error if there is no key for id.
+func (ks *KeyStore) GetPublicKey(id string) (crypto.PublicKey, error) {
+	return ks.GetPublicKeyContext(context.Background(), id)
+}
+
+// GetPublicKeyContext is like GetPublicKey, but stops waiting for the keys to
+// be updated when ctx is done.
+func (ks *KeyStore) GetPublicKeyContext(ctx context.Context, id string) (crypto.PublicKey, error) {
+	entry := ks.lookup(ctx, id)
+	return entry.key, entry.err
+}
+
+func (ks *KeyStore) lookup(ctx context.Context, id string) keyEntry {
+	ret, ok := ks.get(id)
+	if !ok && !ks.isUnknown(id) {
+		updated := ks.tryUpdateKeys(ctx)
+		// Only remember the key ID as unknown if the keys were just fetched:
+		// a throttled or failed update says nothing about it.
+		if ret, ok = ks.get(id); !ok && updated {
+			ks.addUnknown(id)
+		}
 	}
 	return ret
 }
 
+// isUnknown checks if id was recently found to be unknown.
+func (ks *KeyStore) isUnknown(id string) bool {
+	ks.unknownLock.Lock()
+	defer ks.unknownLock.Unlock()
+	until, ok := ks.unknown[id]
+	if ok && time.Now().After(until) {
+		delete(ks.unknown, id)
+		return false
+	}
+	return ok
+}
+
+// addUnknown remembers that id is unknown, keeping at most maxUnknownKeys.
+func (ks *KeyStore) addUnknown(id string) {
+	ks.unknownLock.Lock()
+	defer ks.unknownLock.Unlock()
+	if ks.unknownTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	if len(ks.unknown) >= maxUnknownKeys {
+		for k, until := range ks.unknown {
+			if now.After(until) {
+				delete(ks.unknown, k)
+			}
+		}
+	}
+	if len(ks.unknown) >= maxUnknownKeys {
+		// Still full of fresh entries: drop an arbitrary one.
+		for k := range ks.unknown {
+			delete(ks.unknown, k)
+			break
+		}
+	}
+	ks.unknown[id] = now.Add(ks.unknownTTL)
+}
+
+// forgetUnknown forgets that the given ids were unknown.
+func (ks *KeyStore) forgetUnknown(ids []string) {
+	ks.unknownLock.Lock()
+	defer ks.unknownLock.Unlock()
+	for _, id := range ids {
+		delete(ks.unknown, id)
+	}
+}
+
+// get returns the key for id, unless its grace period is over.
+func (ks *KeyStore) get(id string) (keyEntry, bool) {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	ret, ok := ks.keys[id]
+	if ok && !ret.retired.IsZero() && time.Since(ret.retired) >= ks.gracePeriod {
+		return keyEntry{}, false
+	}
+	return ret, ok
+}
+
 // SetMany sets multiple keys in the KeyStore.
 func (ks *KeyStore) SetMany(keys map[string]PublicKey) {
-	ks.lock.Lock()
+	entries := make(map[string]keyEntry, len(keys))
 	for k, v := range keys {
+		entries[k] = newKeyEntry(v)
+	}
+	ks.lock.Lock()
+	for k, v := range entries {
 		ks.keys[k] = v
 	}
 	ks.lock.Unlock()
@@ -74,30 +259,104 @@ func loadPublicKeysFromFile(filePath string) (map[string]PublicKey, error) {
 	return DecodePublicKeys(f)
 }
 
-// UpdateKeys updates the keys in the KeyStore.
+// UpdateKeys updates the keys in the KeyStore from its KeySource.
 func (ks *KeyStore) UpdateKeys() error {
-	var err error
-	var keys map[string]PublicKey
-	if len(ks.filePath) != 0 {
-		keys, err = loadPublicKeysFromFile(ks.filePath)
-	} else {
-		keys, err = FetchPublicKeys(ks.keyURL)
-	}
+	return ks.UpdateKeysContext(context.Background())
+}
+
+// UpdateKeysContext is like UpdateKeys, but fetches the keys with ctx.
+func (ks *KeyStore) UpdateKeysContext(ctx context.Context) error {
+	set, err := ks.source.FetchKeys(ctx)
 	if err != nil {
 		return fmt.Errorf("load public keys: %w", err)
 	}
-	ks.SetMany(keys)
+	ks.writeCache(set.Keys)
+	ks.replaceKeys(set.Keys, set.Expires)
+	ks.lock.Lock()
+	ks.cachedAt = time.Time{}
+	ks.lock.Unlock()
 	return nil
 }
 
-func (ks *KeyStore) TryUpdateKeys() {
-	ks.updateLock.Lock()
-	defer ks.updateLock.Unlock()
-	if time.Now().Before(ks.nextUpdate) {
-		return
+// replaceKeys replaces the keys in the KeyStore with the given ones.
+// Keys that are missing from the given ones are retired, and removed once
+// their grace period is over.
+func (ks *KeyStore) replaceKeys(keys map[string]PublicKey, expires time.Time) {
+	entries := make(map[string]keyEntry, len(keys))
+	for k, v := range keys {
+		entries[k] = newKeyEntry(v)
+	}
+	now := time.Now()
+	var added, retired, removed []string
+	ks.lock.Lock()
+	for id, entry := range ks.keys {
+		if _, ok := entries[id]; ok {
+			continue
+		}
+		switch {
+		case entry.retired.IsZero() && ks.gracePeriod > 0:
+			entry.retired = now
+			ks.keys[id] = entry
+			retired = append(retired, id)
+		case entry.retired.IsZero() || now.Sub(entry.retired) >= ks.gracePeriod:
+			delete(ks.keys, id)
+			removed = append(removed, id)
+		}
+	}
+	for id, entry := range entries {
+		if old, ok := ks.keys[id]; !ok || !old.retired.IsZero() {
+			added = append(added, id)
+		}
+		ks.keys[id] = entry
+	}
+	ks.expires = expires
+	gracePeriod := ks.gracePeriod
+	ks.lock.Unlock()
+	ks.forgetUnknown(added)
+
+	for _, id := range sortedIDs(added) {
+		log.Printf("Added public key %q\n", id)
 	}
-	ks.nextUpdate = time.Now().Add(5 * time.Second)
-	if err := ks.UpdateKeys(); err != nil {
-		log.Printf("Failed to update public key: %+v", err)
+	for _, id := range sortedIDs(retired) {
+		log.Printf("Retiring public key %q (removed in %v)\n", id, gracePeriod)
+	}
+	for _, id := range sortedIDs(removed) {
+		log.Printf("Removed public key %q\n", id)
+	}
+}
+
+func sortedIDs(ids []string) []string {
+	sort.Strings(ids)
+	return ids
+}
+
+// TryUpdateKeys updates the keys unless they were updated less than 5
+// seconds ago. Concurrent calls share a single update.
+func (ks *KeyStore) TryUpdateKeys() {
+	ks.tryUpdateKeys(context.Background())
+}
+
+// tryUpdateKeys is like TryUpdateKeys, but stops waiting when ctx is done.
+// The shared update itself is not canceled, since other callers may be
+// waiting for it. It returns whether the keys were fetched successfully.
+func (ks *KeyStore) tryUpdateKeys(ctx context.Context) bool {
+	ch := ks.updateGroup.DoChan("update", func() (interface{}, error) {
+		ks.updateLock.Lock()
+		defer ks.updateLock.Unlock()
+		if time.Now().Before(ks.nextUpdate) {
+			return false, nil
+		}
+		ks.nextUpdate = time.Now().Add(5 * time.Second)
+		if err := ks.UpdateKeysContext(context.WithoutCancel(ctx)); err != nil {
+			log.Printf("Failed to update public key: %+v", err)
+			return false, nil
+		}
+		return true, nil
+	})
+	select {
+	case res := <-ch:
+		return res.Val.(bool)
+	case <-ctx.Done():
+		return false
 	}
 }
@@ -2,7 +2,14 @@ package jwt
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestKeyStore(t *testing.T) {
@@ -39,3 +46,145 @@ func TestKeyStore(t *testing.T) {
 		t.Errorf("IsEmpty failed, expected false, got true")
 	}
 }
+
+func TestKeyStoreGetECDSAKey(t *testing.T) {
+	key, pub := newTestKey(t)
+	ks := NewKeyStore("", "")
+	ks.SetMany(map[string]PublicKey{
+		"key1": pub,
+		"bad":  []byte("testkey"),
+	})
+
+	if k, err := ks.GetECDSAKey("key1"); err != nil || !k.Equal(&key.PublicKey) {
+		t.Errorf("GetECDSAKey failed, expected parsed key, got %v (%v)", k, err)
+	}
+	if _, err := ks.GetECDSAKey("bad"); err == nil {
+		t.Errorf("GetECDSAKey failed, expected parse error, got nil")
+	}
+	if k, err := ks.GetECDSAKey("key2"); k != nil || err != nil {
+		t.Errorf("GetECDSAKey failed, expected nil, got %v (%v)", k, err)
+	}
+}
+
+func TestKeyStoreRetiredKeys(t *testing.T) {
+	_, pub1 := newTestKey(t)
+	_, pub2 := newTestKey(t)
+	path := filepath.Join(t.TempDir(), "keys.json")
+	writeKeys := func(keys map[string]string) {
+		t.Helper()
+		b, err := json.Marshal(keys)
+		if err != nil {
+			t.Fatalf("Failed to marshal json: %+v", err)
+		}
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatalf("Failed to write keys: %+v", err)
+		}
+	}
+
+	writeKeys(map[string]string{"key1": string(pub1), "key2": string(pub2)})
+	ks := NewKeyStore(path, "")
+	ks.SetRetiredKeyGracePeriod(100 * time.Millisecond)
+	if err := ks.UpdateKeys(); err != nil {
+		t.Fatalf("Failed to update keys: %+v", err)
+	}
+
+	writeKeys(map[string]string{"key1": string(pub1)})
+	if err := ks.UpdateKeys(); err != nil {
+		t.Fatalf("Failed to update keys: %+v", err)
+	}
+	if k := ks.GetKey("key2"); k == nil {
+		t.Error("retired key should be kept during its grace period")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if k := ks.GetKey("key2"); k != nil {
+		t.Error("retired key should not be returned after its grace period")
+	}
+	if k := ks.GetKey("key1"); k == nil {
+		t.Error("published key should be kept")
+	}
+
+	t.Run("no grace period", func(t *testing.T) {
+		writeKeys(map[string]string{"key1": string(pub1), "key2": string(pub2)})
+		ks := NewKeyStore(path, "")
+		ks.SetRetiredKeyGracePeriod(0)
+		if err := ks.UpdateKeys(); err != nil {
+			t.Fatalf("Failed to update keys: %+v", err)
+		}
+		writeKeys(map[string]string{"key2": string(pub2)})
+		if err := ks.UpdateKeys(); err != nil {
+			t.Fatalf("Failed to update keys: %+v", err)
+		}
+		ks.lock.RLock()
+		_, ok := ks.keys["key1"]
+		ks.lock.RUnlock()
+		if ok {
+			t.Error("removed key should be evicted immediately")
+		}
+	})
+}
+
+type countingKeySource struct {
+	calls int32
+	delay time.Duration
+}
+
+func (s *countingKeySource) FetchKeys(ctx context.Context) (*KeySet, error) {
+	atomic.AddInt32(&s.calls, 1)
+	time.Sleep(s.delay)
+	return &KeySet{Keys: map[string]PublicKey{"key1": []byte("testkey")}}, nil
+}
+
+func TestKeyStoreUnknownKeys(t *testing.T) {
+	src := &countingKeySource{delay: 50 * time.Millisecond}
+	ks := NewKeyStoreWithSource(src)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ks.GetKey("unknown")
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&src.calls); n != 1 {
+		t.Errorf("expected concurrent lookups to share 1 update, got %d", n)
+	}
+
+	// Even once updates are no longer throttled, the unknown key ID must not
+	// trigger another update until its negative cache entry expires.
+	ks.updateLock.Lock()
+	ks.nextUpdate = time.Time{}
+	ks.updateLock.Unlock()
+	if k := ks.GetKey("unknown"); k != nil {
+		t.Errorf("expected nil, got %v", k)
+	}
+	if n := atomic.LoadInt32(&src.calls); n != 1 {
+		t.Errorf("expected unknown key ID to be cached, got %d updates", n)
+	}
+
+	ks.SetUnknownKeyTTL(0)
+	ks.GetKey("other")
+	if n := atomic.LoadInt32(&src.calls); n != 2 {
+		t.Errorf("expected another update for a new key ID, got %d updates", n)
+	}
+
+	// A key ID looked up while updates are throttled must not be remembered
+	// as unknown, so that it triggers an update once they are not.
+	ks.SetUnknownKeyTTL(DefaultUnknownKeyTTL)
+	ks.GetKey("rotated")
+	if n := atomic.LoadInt32(&src.calls); n != 2 {
+		t.Errorf("expected updates to be throttled, got %d updates", n)
+	}
+	if ks.isUnknown("rotated") {
+		t.Error("expected key ID looked up while throttled not to be cached")
+	}
+	ks.updateLock.Lock()
+	ks.nextUpdate = time.Time{}
+	ks.updateLock.Unlock()
+	ks.GetKey("rotated")
+	if n := atomic.LoadInt32(&src.calls); n != 3 {
+		t.Errorf("expected an update once no longer throttled, got %d updates", n)
+	}
+}
@@ -0,0 +1,49 @@
+package jwt
+
+import (
+	"context"
+	"net/http"
+)
+
+type claimsContextKey struct{}
+
+// ErrorHandler handles requests whose token failed verification.
+// Claims may be non-nil even though verification failed.
+type ErrorHandler func(res http.ResponseWriter, req *http.Request, claims *Claims, err error)
+
+// DefaultErrorHandler responds with 401 Unauthorized.
+func DefaultErrorHandler(res http.ResponseWriter, req *http.Request, claims *Claims, err error) {
+	http.Error(res, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// Middleware returns a net/http middleware that verifies the token in each
+// request and makes the verified Claims available to the next handler through
+// ClaimsFromContext. Requests that fail verification are passed to onError
+// instead, or to DefaultErrorHandler if onError is nil.
+func Middleware(cfg *Config, onError ErrorHandler) func(http.Handler) http.Handler {
+	if onError == nil {
+		onError = DefaultErrorHandler
+	}
+	v := NewVerifier(cfg)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			claims, err := v.VerifyRequest(req)
+			if err != nil {
+				onError(res, req, claims, err)
+				return
+			}
+			next.ServeHTTP(res, req.WithContext(NewContext(req.Context(), claims)))
+		})
+	}
+}
+
+// NewContext returns a copy of ctx that carries the verified Claims.
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsContextKey{}, claims)
+}
+
+// ClaimsFromContext returns the verified Claims stored in ctx, if any.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey{}).(*Claims)
+	return claims, ok && claims != nil
+}
@@ -0,0 +1,66 @@
+package jwt
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func TestMiddleware(t *testing.T) {
+	key, pub := newTestKey(t)
+	cfg := newTestConfig(t, map[string]PublicKey{"key1": pub})
+
+	var gotClaims *Claims
+	var gotErr error
+	next := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		gotClaims, _ = ClaimsFromContext(req.Context())
+	})
+	onError := func(res http.ResponseWriter, req *http.Request, claims *Claims, err error) {
+		gotErr = err
+		res.WriteHeader(http.StatusTeapot)
+	}
+	h := Middleware(cfg, onError)(next)
+
+	t.Run("valid", func(t *testing.T) {
+		gotClaims, gotErr = nil, nil
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(tokenHeader, signTestToken(t, jwt.MapClaims{
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"aud":   testAudience,
+			"iss":   issuerClaim,
+			"email": "user@example.com",
+		}, "key1", key))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("unexpected status: %d", rec.Code)
+		}
+		if gotErr != nil {
+			t.Errorf("unexpected error: %v", gotErr)
+		}
+		if gotClaims == nil || gotClaims.Email != "user@example.com" {
+			t.Errorf("unexpected claims in context: %+v", gotClaims)
+		}
+	})
+
+	t.Run("missing token", func(t *testing.T) {
+		gotClaims, gotErr = nil, nil
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusTeapot {
+			t.Errorf("unexpected status: %d", rec.Code)
+		}
+		if !errors.Is(gotErr, ErrMissingToken) {
+			t.Errorf("expected ErrMissingToken, got %v", gotErr)
+		}
+		if gotClaims != nil {
+			t.Error("next handler should not be called")
+		}
+	})
+}
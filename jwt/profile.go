@@ -0,0 +1,124 @@
+package jwt
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+const (
+	// IAPPublicKeysURL is the URL of the public keys used by Cloud IAP.
+	IAPPublicKeysURL = "https://www.gstatic.com/iap/verify/public_key"
+	// GoogleOIDCPublicKeysURL is the URL of the public keys (JWK Set) used
+	// by Google to sign OpenID Connect ID tokens.
+	GoogleOIDCPublicKeysURL = "https://www.googleapis.com/oauth2/v3/certs"
+)
+
+// Profile describes how the tokens of an issuer are found and verified.
+type Profile struct {
+	// Name identifies the profile in logs and errors.
+	Name string
+	// Issuers are the accepted values of the iss claim.
+	Issuers []string
+	// Algorithms are the accepted signing algorithms (alg header).
+	Algorithms []string
+	// PublicKeys are the keys tokens must be signed with.
+	PublicKeys *KeyStore
+	// TokenSource finds the token in requests.
+	TokenSource TokenSource
+	// MatchAudiences must match the aud claim.
+	MatchAudiences *regexp.Regexp
+	// ValidateAudience, if non-nil, checks the format of the aud claim
+	// before it is matched against MatchAudiences.
+	ValidateAudience func(aud string) error
+	// RequireVerifiedEmail rejects tokens with an email claim unless their
+	// email_verified claim is true.
+	RequireVerifiedEmail bool
+}
+
+// IAPProfileName is the Name of the Profile returned by NewIAPProfile.
+const IAPProfileName = "iap"
+
+// NewIAPProfile returns the Profile of tokens signed by Cloud IAP, found in
+// the X-Goog-IAP-JWT-Assertion header.
+func NewIAPProfile(publicKeys *KeyStore, matchAudiences *regexp.Regexp) *Profile {
+	return &Profile{
+		Name:             IAPProfileName,
+		Issuers:          []string{issuerClaim},
+		Algorithms:       []string{algorithm},
+		PublicKeys:       publicKeys,
+		TokenSource:      HeaderTokenSource(tokenHeader),
+		MatchAudiences:   matchAudiences,
+		ValidateAudience: validateIAPAudience,
+	}
+}
+
+// NewGoogleOIDCProfile returns the Profile of OpenID Connect ID tokens signed
+// by Google, found in the Authorization header as bearer tokens. Their email
+// must be verified, since it is trusted like that of IAP tokens.
+// publicKeys would usually load keys from GoogleOIDCPublicKeysURL.
+func NewGoogleOIDCProfile(publicKeys *KeyStore, matchAudiences *regexp.Regexp) *Profile {
+	return &Profile{
+		Name:                 "google-oidc",
+		Issuers:              []string{"https://accounts.google.com", "accounts.google.com"},
+		Algorithms:           []string{"RS256"},
+		PublicKeys:           publicKeys,
+		TokenSource:          BearerTokenSource{},
+		MatchAudiences:       matchAudiences,
+		RequireVerifiedEmail: true,
+	}
+}
+
+// Validate validates the Profile.
+func (p *Profile) Validate() error {
+	if len(p.Issuers) == 0 {
+		return fmt.Errorf("No issuers defined for profile %q", p.Name)
+	}
+	if len(p.Algorithms) == 0 {
+		return fmt.Errorf("No algorithms defined for profile %q", p.Name)
+	}
+	if p.TokenSource == nil {
+		return fmt.Errorf("No token source defined for profile %q", p.Name)
+	}
+	if p.MatchAudiences == nil {
+		return errors.New("No audiences to match defined")
+	}
+	if p.PublicKeys == nil || p.PublicKeys.IsEmpty() {
+		return errors.New("No public keys defined")
+	}
+	return nil
+}
+
+func (p *Profile) hasIssuer(iss string) bool {
+	for _, i := range p.Issuers {
+		if i == iss {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Profile) hasAlgorithm(alg string) bool {
+	for _, a := range p.Algorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Profile) validAudience(aud string) error {
+	if p.ValidateAudience != nil {
+		if err := p.ValidateAudience(aud); err != nil {
+			return newVerificationError(ErrInvalidAudience, "%v", err)
+		}
+	}
+	if !p.MatchAudiences.MatchString(aud) {
+		return newVerificationError(ErrInvalidAudience, "unexpected audience %q", aud)
+	}
+	return nil
+}
+
+func validateIAPAudience(aud string) error {
+	return NewAudience(aud).Validate()
+}
@@ -0,0 +1,172 @@
+package jwt
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+const testOIDCAudience = "https://backend.example.com"
+
+func newTestRSAKey(t testing.TB) (*rsa.PrivateKey, PublicKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	b, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %+v", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})
+}
+
+func signTestRSAToken(t testing.TB, claims jwt.Claims, kid string, key *rsa.PrivateKey) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %+v", err)
+	}
+	return s
+}
+
+func TestProfiles(t *testing.T) {
+	iapKey, iapPub := newTestKey(t)
+	oidcKey, oidcPub := newTestRSAKey(t)
+	iapKeys := NewKeyStoreWithSource(StaticKeySource{"iap1": iapPub})
+	oidcKeys := NewKeyStoreWithSource(StaticKeySource{"oidc1": oidcPub})
+	for _, ks := range []*KeyStore{iapKeys, oidcKeys} {
+		if err := ks.UpdateKeys(); err != nil {
+			t.Fatalf("Failed to update keys: %+v", err)
+		}
+	}
+	cfg := &Config{
+		Profiles: []*Profile{
+			NewIAPProfile(iapKeys, regexp.MustCompile("^"+regexp.QuoteMeta(testAudience)+"$")),
+			NewGoogleOIDCProfile(oidcKeys, regexp.MustCompile("^"+regexp.QuoteMeta(testOIDCAudience)+"$")),
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid config: %+v", err)
+	}
+	v := NewVerifier(cfg)
+
+	iapToken := signTestToken(t, jwt.MapClaims{
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"aud":   testAudience,
+		"iss":   issuerClaim,
+		"email": "user@example.com",
+	}, "iap1", iapKey)
+	oidcToken := signTestRSAToken(t, jwt.MapClaims{
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"aud":            testOIDCAudience,
+		"iss":            "https://accounts.google.com",
+		"email":          "robot@project.iam.gserviceaccount.com",
+		"email_verified": true,
+	}, "oidc1", oidcKey)
+	unverifiedToken := signTestRSAToken(t, jwt.MapClaims{
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"aud":            testOIDCAudience,
+		"iss":            "https://accounts.google.com",
+		"email":          "ceo@corp.example",
+		"email_verified": false,
+	}, "oidc1", oidcKey)
+	noEmailToken := signTestRSAToken(t, jwt.MapClaims{
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+		"aud": testOIDCAudience,
+		"iss": "https://accounts.google.com",
+	}, "oidc1", oidcKey)
+
+	testCases := []struct {
+		name    string
+		header  string
+		value   string
+		profile string
+		err     error
+	}{
+		{name: "iap", header: tokenHeader, value: iapToken, profile: "iap"},
+		{name: "oidc", header: "Authorization", value: "Bearer " + oidcToken, profile: "google-oidc"},
+		{name: "iap token as bearer", header: "Authorization", value: "Bearer " + iapToken, err: ErrInvalidAlgorithm},
+		{name: "oidc token in iap header", header: tokenHeader, value: oidcToken, err: ErrInvalidAlgorithm},
+		{name: "no token", header: "X-Other", value: "token", err: ErrMissingToken},
+		{name: "oidc unverified email", header: "Authorization", value: "Bearer " + unverifiedToken, err: ErrUnverifiedEmail},
+		{name: "oidc without email", header: "Authorization", value: "Bearer " + noEmailToken, profile: "google-oidc"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(tc.header, tc.value)
+			claims, err := v.VerifyRequest(req)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("expected error %v, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("expected no error, got error:", err)
+			}
+			if claims.Profile().Name != tc.profile {
+				t.Errorf("unexpected profile: %q", claims.Profile().Name)
+			}
+		})
+	}
+
+	t.Run("verify by issuer", func(t *testing.T) {
+		claims, err := v.Verify(context.Background(), oidcToken)
+		if err != nil {
+			t.Fatal("expected no error, got error:", err)
+		}
+		if !claims.EmailVerified || claims.Profile().Name != "google-oidc" {
+			t.Errorf("unexpected claims: %+v", claims)
+		}
+		other := signTestRSAToken(t, jwt.MapClaims{"iss": "https://issuer.example.com"}, "oidc1", oidcKey)
+		if _, err := v.Verify(context.Background(), other); !errors.Is(err, ErrInvalidIssuer) {
+			t.Errorf("expected error %v, got %v", ErrInvalidIssuer, err)
+		}
+	})
+}
+
+func TestDecodePublicKeysRSAJWKS(t *testing.T) {
+	key, _ := newTestRSAKey(t)
+	set := fmt.Sprintf(`{"keys": [{"kty": "RSA", "kid": "rsa1", "alg": "RS256", "use": "sig", "n": %q, "e": %q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+
+	keys, err := DecodePublicKeys(strings.NewReader(set))
+	if err != nil {
+		t.Fatalf("Failed to decode public keys: %+v", err)
+	}
+	ks := NewKeyStoreWithSource(StaticKeySource(keys))
+	if err := ks.UpdateKeys(); err != nil {
+		t.Fatalf("Failed to update keys: %+v", err)
+	}
+	got, err := ks.GetPublicKey("rsa1")
+	if err != nil {
+		t.Fatalf("Failed to get key: %+v", err)
+	}
+	if rsaKey, ok := got.(*rsa.PublicKey); !ok || !rsaKey.Equal(&key.PublicKey) {
+		t.Errorf("unexpected key: %v", got)
+	}
+}
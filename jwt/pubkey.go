@@ -1,14 +1,22 @@
 package jwt
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var (
-	// HTTPClient is the default HTTP Client to use for fetching public keys.
+	// HTTPClient is the default HTTP Client to use for fetching public keys,
+	// used by URLKeySource when its Client is nil.
 	HTTPClient = &http.Client{Timeout: 10 * time.Second}
 )
 
@@ -21,26 +29,88 @@ func CreatePublicKey(b []byte) PublicKey {
 }
 
 // DecodePublicKeys decodes all public keys from the given Reader.
+// The format is detected automatically: both Google's legacy format (a JSON
+// object mapping key IDs to PEM encoded keys, as published at
+// https://www.gstatic.com/iap/verify/public_key) and JSON Web Key Sets (as
+// published at https://www.gstatic.com/iap/verify/public_key-jwk) are
+// supported.
 func DecodePublicKeys(r io.Reader) (map[string]PublicKey, error) {
-	var skeys map[string]string
-	if err := json.NewDecoder(r).Decode(&skeys); err != nil {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
 		return nil, err
 	}
+	if keys, ok := raw["keys"]; ok && bytes.HasPrefix(bytes.TrimSpace(keys), []byte("[")) {
+		return decodeJWKSPublicKeys(keys)
+	}
 	bkeys := make(map[string]PublicKey)
-	for k, v := range skeys {
-		if len(v) != 0 {
-			bkeys[k] = CreatePublicKey([]byte(v))
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return nil, err
+		}
+		if len(s) != 0 {
+			bkeys[k] = CreatePublicKey([]byte(s))
 		}
 	}
 	return bkeys, nil
 }
 
+func decodeJWKSPublicKeys(b []byte) (map[string]PublicKey, error) {
+	var set jwks
+	if err := json.Unmarshal(b, &set.Keys); err != nil {
+		return nil, err
+	}
+	keys, err := set.publicKeys()
+	if err != nil {
+		return nil, err
+	}
+	bkeys := make(map[string]PublicKey)
+	for k, v := range keys {
+		b, err := encodePublicKey(v)
+		if err != nil {
+			return nil, err
+		}
+		bkeys[k] = b
+	}
+	return bkeys, nil
+}
+
+func encodePublicKey(key crypto.PublicKey) (PublicKey, error) {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return CreatePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})), nil
+}
+
 // FetchPublicKeys downloads and decodes all public keys from Google.
 func FetchPublicKeys(keyURL string) (map[string]PublicKey, error) {
-	r, err := HTTPClient.Get(keyURL)
+	set, err := (&URLKeySource{URL: keyURL}).FetchKeys(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	defer r.Body.Close()
-	return DecodePublicKeys(r.Body)
+	return set.Keys, nil
+}
+
+// cacheExpiry returns when a response expires according to its
+// Cache-Control max-age (minus Age) or Expires headers, or zero if unknown.
+func cacheExpiry(h http.Header, now time.Time) time.Time {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return now
+		case "max-age":
+			maxAge, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+			if err != nil {
+				continue
+			}
+			age, _ := strconv.ParseInt(h.Get("Age"), 10, 64)
+			return now.Add(time.Duration(maxAge-age) * time.Second)
+		}
+	}
+	if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+		return expires
+	}
+	return time.Time{}
 }
@@ -0,0 +1,113 @@
+package jwt
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+var (
+	// minRefreshInterval is the minimum time between two background refreshes.
+	minRefreshInterval = 5 * time.Second
+	// maxRefreshBackoff is the maximum time to wait before retrying a failed
+	// background refresh.
+	maxRefreshBackoff = 5 * time.Minute
+)
+
+// StartRefresh starts refreshing the keys in the background, ahead of key
+// rotations, until Close is called.
+// Refreshes are scheduled from the Cache-Control max-age or Expires headers
+// of the fetched keys, falling back to interval when there are none (eg: for
+// keys loaded from a file). Failed refreshes are retried with exponential
+// backoff. Calling StartRefresh more than once has no effect.
+func (ks *KeyStore) StartRefresh(interval time.Duration) {
+	ks.refreshLock.Lock()
+	defer ks.refreshLock.Unlock()
+	if ks.stop != nil {
+		return
+	}
+	ks.stop = make(chan struct{})
+	ks.done = make(chan struct{})
+	go ks.refreshLoop(interval, ks.stop, ks.done)
+}
+
+// Close stops the background refresh started by StartRefresh, if any, and
+// waits for it to finish.
+func (ks *KeyStore) Close() error {
+	ks.refreshLock.Lock()
+	defer ks.refreshLock.Unlock()
+	if ks.stop == nil {
+		return nil
+	}
+	close(ks.stop)
+	<-ks.done
+	ks.stop, ks.done = nil, nil
+	return nil
+}
+
+func (ks *KeyStore) refreshLoop(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	var backoff time.Duration
+	for {
+		delay := backoff
+		if delay == 0 {
+			delay = ks.refreshDelay(interval)
+		}
+		timer := time.NewTimer(withJitter(delay))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := ks.refresh(); err != nil {
+			backoff = nextBackoff(backoff)
+			log.Printf("Failed to refresh public keys, retrying in %v: %+v", backoff, err)
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// refresh updates the keys, serialized with TryUpdateKeys.
+func (ks *KeyStore) refresh() error {
+	ks.updateLock.Lock()
+	defer ks.updateLock.Unlock()
+	ks.nextUpdate = time.Now().Add(5 * time.Second)
+	return ks.UpdateKeys()
+}
+
+// refreshDelay returns how long to wait until the next refresh.
+func (ks *KeyStore) refreshDelay(interval time.Duration) time.Duration {
+	ks.lock.RLock()
+	expires := ks.expires
+	ks.lock.RUnlock()
+	delay := interval
+	if !expires.IsZero() {
+		delay = time.Until(expires)
+	}
+	if delay < minRefreshInterval {
+		delay = minRefreshInterval
+	}
+	return delay
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return minRefreshInterval
+	}
+	backoff *= 2
+	if backoff > maxRefreshBackoff {
+		backoff = maxRefreshBackoff
+	}
+	return backoff
+}
+
+// withJitter shortens d by up to 10% so that many instances do not refresh
+// at the same time.
+func withJitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/10+1))
+}
@@ -0,0 +1,102 @@
+package jwt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheExpiry(t *testing.T) {
+	now := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	testTable := []struct {
+		name   string
+		header http.Header
+		want   time.Time
+	}{
+		{
+			name:   "no headers",
+			header: http.Header{},
+		},
+		{
+			name:   "max-age",
+			header: http.Header{"Cache-Control": {"public, max-age=3600, must-revalidate"}},
+			want:   now.Add(time.Hour),
+		},
+		{
+			name:   "max-age with age",
+			header: http.Header{"Cache-Control": {"public, max-age=3600"}, "Age": {"600"}},
+			want:   now.Add(50 * time.Minute),
+		},
+		{
+			name:   "no-cache",
+			header: http.Header{"Cache-Control": {"no-cache"}},
+			want:   now,
+		},
+		{
+			name:   "expires",
+			header: http.Header{"Expires": {"Mon, 01 Jul 2024 02:00:00 GMT"}},
+			want:   now.Add(2 * time.Hour),
+		},
+		{
+			name:   "max-age takes precedence over expires",
+			header: http.Header{"Cache-Control": {"max-age=60"}, "Expires": {"Mon, 01 Jul 2024 02:00:00 GMT"}},
+			want:   now.Add(time.Minute),
+		},
+	}
+
+	for _, tc := range testTable {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cacheExpiry(tc.header, now); !got.Equal(tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestKeyStoreRefresh(t *testing.T) {
+	defer func(d time.Duration) { minRefreshInterval = d }(minRefreshInterval)
+	minRefreshInterval = 10 * time.Millisecond
+
+	_, pub := newTestKey(t)
+	body, err := json.Marshal(map[string]string{"key1": string(pub)})
+	if err != nil {
+		t.Fatalf("Failed to marshal json: %+v", err)
+	}
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Cache-Control", "max-age=0")
+		if _, err := w.Write(body); err != nil {
+			t.Errorf("Failed to write response: %+v", err)
+		}
+	}))
+	defer srv.Close()
+
+	ks := NewKeyStore("", srv.URL)
+	if err := ks.UpdateKeys(); err != nil {
+		t.Fatalf("Failed to update keys: %+v", err)
+	}
+	ks.StartRefresh(time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&fetches) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := ks.Close(); err != nil {
+		t.Fatalf("Failed to close key store: %+v", err)
+	}
+	n := atomic.LoadInt32(&fetches)
+	if n < 3 {
+		t.Fatalf("expected at least 2 background fetches, got %d", n-1)
+	}
+	if ks.IsEmpty() {
+		t.Error("expected keys to be loaded")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&fetches) != n {
+		t.Error("keys were fetched after Close")
+	}
+}
@@ -1,10 +1,7 @@
 package jwt
 
 import (
-	"errors"
 	"net/http"
-
-	jwt "github.com/golang-jwt/jwt/v4"
 )
 
 // ValidateRequestClaims checks the validity of the claims in the request.
@@ -16,19 +13,5 @@ func ValidateRequestClaims(req *http.Request, cfg *Config) error {
 // RequestClaims checks the validity and returns the claims in the request.
 // Claims may be returned even if an error occurs.
 func RequestClaims(req *http.Request, cfg *Config) (*Claims, error) {
-	tokenString, err := tokenStringFromRequest(req)
-	if err != nil {
-		return nil, err
-	}
-	claims := &Claims{cfg: cfg}
-	_, err = jwt.ParseWithClaims(tokenString, claims, tokenKey)
-	return claims, err
-}
-
-func tokenStringFromRequest(req *http.Request) (string, error) {
-	token := req.Header.Get(tokenHeader)
-	if len(token) == 0 {
-		return "", errors.New("Token was not found in the request headers")
-	}
-	return token, nil
+	return NewVerifier(cfg).VerifyRequest(req)
 }
@@ -0,0 +1,31 @@
+package jwt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func BenchmarkRequestClaims(b *testing.B) {
+	key, pub := newTestKey(b)
+	cfg := newTestConfig(b, map[string]PublicKey{"key1": pub})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(tokenHeader, signTestToken(b, jwt.MapClaims{
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"aud":   testAudience,
+		"iss":   issuerClaim,
+		"email": "user@example.com",
+	}, "key1", key))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := RequestClaims(req, cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
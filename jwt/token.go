@@ -1,7 +1,7 @@
 package jwt
 
 import (
-	"fmt"
+	"context"
 
 	"github.com/golang-jwt/jwt/v4"
 )
@@ -14,29 +14,23 @@ const (
 	issuerClaim    = "https://cloud.google.com/iap"
 )
 
-func tokenKey(token *jwt.Token) (interface{}, error) {
-	if _, ok := tokenMethod(token); !ok {
-		return nil, fmt.Errorf("Invalid algorithm: %v", token.Header[algorithmClaim])
+func tokenKey(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	profile := token.Claims.(*Claims).Profile()
+	if !tokenMethodAllowed(token, profile) {
+		return nil, newVerificationError(ErrInvalidAlgorithm, "%v", token.Header[algorithmClaim])
 	}
 	keyID, _ := token.Header[keyIDClaim].(string)
-	key := token.Claims.(*Claims).cfg.PublicKeys.GetKey(keyID)
-	if len(key) == 0 {
-		return nil, fmt.Errorf("No public key for %q", keyID)
-	}
-	parsedKey, err := jwt.ParseECPublicKeyFromPEM(key)
+	key, err := profile.PublicKeys.GetPublicKeyContext(ctx, keyID)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse key: %v", err)
+		return nil, newVerificationError(ErrUnknownKeyID, "failed to parse key %q: %v", keyID, err)
+	}
+	if key == nil {
+		return nil, newVerificationError(ErrUnknownKeyID, "%q", keyID)
 	}
-	return parsedKey, nil
+	return key, nil
 }
 
-func tokenMethod(token *jwt.Token) (jwt.SigningMethod, bool) {
-	if token.Header[algorithmClaim] != algorithm {
-		return nil, false
-	}
-	method, ok := token.Method.(*jwt.SigningMethodECDSA)
-	if !ok {
-		return nil, false
-	}
-	return method, true
+func tokenMethodAllowed(token *jwt.Token, profile *Profile) bool {
+	alg, _ := token.Header[algorithmClaim].(string)
+	return token.Method != nil && token.Method.Alg() == alg && profile.hasAlgorithm(alg)
 }
@@ -0,0 +1,126 @@
+package jwt
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TokenSource finds the token in a request.
+type TokenSource interface {
+	// Token returns the token in the request, or an empty string if there is
+	// none.
+	Token(req *http.Request) string
+	// String describes where the token is looked for.
+	String() string
+}
+
+// HeaderTokenSource is a TokenSource that reads the token from the named
+// header.
+type HeaderTokenSource string
+
+// Token implements the TokenSource interface.
+func (s HeaderTokenSource) Token(req *http.Request) string {
+	return req.Header.Get(string(s))
+}
+
+// String implements the TokenSource interface.
+func (s HeaderTokenSource) String() string {
+	return fmt.Sprintf("%s header", string(s))
+}
+
+// BearerTokenSource is a TokenSource that reads bearer tokens from the
+// Authorization header.
+type BearerTokenSource struct{}
+
+// Token implements the TokenSource interface.
+func (BearerTokenSource) Token(req *http.Request) string {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// String implements the TokenSource interface.
+func (BearerTokenSource) String() string {
+	return "Authorization: Bearer header"
+}
+
+// CookieTokenSource is a TokenSource that reads the token from the named
+// cookie.
+type CookieTokenSource string
+
+// Token implements the TokenSource interface.
+func (s CookieTokenSource) Token(req *http.Request) string {
+	c, err := req.Cookie(string(s))
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// String implements the TokenSource interface.
+func (s CookieTokenSource) String() string {
+	return fmt.Sprintf("%s cookie", string(s))
+}
+
+// QueryTokenSource is a TokenSource that reads the token from the named
+// query parameter, eg: for WebSocket clients that cannot set headers.
+type QueryTokenSource string
+
+// Token implements the TokenSource interface.
+func (s QueryTokenSource) Token(req *http.Request) string {
+	return req.URL.Query().Get(string(s))
+}
+
+// String implements the TokenSource interface.
+func (s QueryTokenSource) String() string {
+	return fmt.Sprintf("%s query parameter", string(s))
+}
+
+// ParseTokenSource parses a TokenSource from a string, which must be one of
+// "header:NAME", "bearer", "cookie:NAME" or "query:NAME".
+func ParseTokenSource(str string) (TokenSource, error) {
+	kind, name, _ := strings.Cut(str, ":")
+	switch {
+	case kind == "bearer" && len(name) == 0:
+		return BearerTokenSource{}, nil
+	case kind == "header" && len(name) != 0:
+		return HeaderTokenSource(name), nil
+	case kind == "cookie" && len(name) != 0:
+		return CookieTokenSource(name), nil
+	case kind == "query" && len(name) != 0:
+		return QueryTokenSource(name), nil
+	}
+	return nil, fmt.Errorf("token source %q must be one of \"header:NAME\", \"bearer\", \"cookie:NAME\" or \"query:NAME\"", str)
+}
+
+// tokenFromSources returns the token found by the first of the sources that
+// finds one. Other sources must find either no token or the same token.
+func tokenFromSources(req *http.Request, sources []TokenSource) (string, error) {
+	var token string
+	var from TokenSource
+	for _, s := range sources {
+		t := s.Token(req)
+		switch {
+		case len(t) == 0:
+		case len(token) == 0:
+			token, from = t, s
+		case t != token:
+			return "", newVerificationError(ErrConflictingTokens, "%s and %s differ", from, s)
+		}
+	}
+	if len(token) == 0 {
+		return "", missingTokenError(sources)
+	}
+	return token, nil
+}
+
+func missingTokenError(sources []TokenSource) error {
+	strs := make([]string, 0, len(sources))
+	for _, s := range sources {
+		strs = append(strs, s.String())
+	}
+	return newVerificationError(ErrMissingToken, "no %s in the request", strings.Join(strs, " or "))
+}
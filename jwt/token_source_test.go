@@ -0,0 +1,104 @@
+package jwt
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func TestParseTokenSource(t *testing.T) {
+	tests := []struct {
+		str  string
+		want TokenSource
+	}{
+		{"bearer", BearerTokenSource{}},
+		{"header:X-Goog-Authenticated-User-JWT", HeaderTokenSource("X-Goog-Authenticated-User-JWT")},
+		{"cookie:token", CookieTokenSource("token")},
+		{"query:access_token", QueryTokenSource("access_token")},
+		{"bearer:x", nil},
+		{"header", nil},
+		{"cookie:", nil},
+		{"body:token", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseTokenSource(tt.str)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", tt.str, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %v, %v; want %v", tt.str, got, err, tt.want)
+		}
+	}
+}
+
+func TestConfigTokenSources(t *testing.T) {
+	key, pub := newTestKey(t)
+	cfg := newTestConfig(t, map[string]PublicKey{"key1": pub})
+	cfg.TokenSources = []TokenSource{
+		HeaderTokenSource("X-Goog-Authenticated-User-JWT"),
+		CookieTokenSource("token"),
+		QueryTokenSource("access_token"),
+	}
+	token := signTestToken(t, jwt.MapClaims{
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+		"aud": testAudience,
+		"iss": issuerClaim,
+	}, "key1", key)
+	other := signTestToken(t, jwt.MapClaims{
+		"exp": time.Now().Add(2 * time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+		"aud": testAudience,
+		"iss": issuerClaim,
+	}, "key1", key)
+
+	tests := []struct {
+		name    string
+		header  string
+		cookie  string
+		query   string
+		wantErr error
+	}{
+		{name: "header", header: token},
+		{name: "cookie", cookie: token},
+		{name: "query", query: token},
+		{name: "same token twice", header: token, query: token},
+		{name: "conflicting tokens", header: token, cookie: other, wantErr: ErrConflictingTokens},
+		{name: "missing token", wantErr: ErrMissingToken},
+	}
+	v := NewVerifier(cfg)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/"
+			if tt.query != "" {
+				target += "?access_token=" + tt.query
+			}
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if tt.header != "" {
+				req.Header.Set("X-Goog-Authenticated-User-JWT", tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "token", Value: tt.cookie})
+			}
+			// The default source is not used when TokenSources are set.
+			req.Header.Set(tokenHeader, other)
+			_, err := v.VerifyRequest(req)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
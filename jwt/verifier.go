@@ -0,0 +1,84 @@
+package jwt
+
+import (
+	"context"
+	"net/http"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// Verifier verifies JWT tokens against a Config.
+// Unlike RequestClaims, it does not depend on *http.Request, so it can be
+// used for tokens received by other means (queues, WebSockets, logs, etc).
+type Verifier struct {
+	cfg      *Config
+	profiles []*Profile
+}
+
+// NewVerifier creates a new Verifier for the given Config.
+func NewVerifier(cfg *Config) *Verifier {
+	return &Verifier{cfg: cfg, profiles: cfg.profiles()}
+}
+
+// Verify checks the validity and returns the claims in the token string.
+// The token is verified with the Profile matching its issuer.
+// Fetching the keys of an unknown key ID, if needed, is bound to ctx.
+// Claims may be returned even if an error occurs, in which case the error
+// is a *VerificationError.
+func (v *Verifier) Verify(ctx context.Context, tokenString string) (*Claims, error) {
+	profile := v.profiles[0]
+	if len(v.profiles) > 1 {
+		var unverified jwt.StandardClaims
+		if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, &unverified); err != nil {
+			return nil, verificationError(err)
+		}
+		if profile = v.profileForIssuer(unverified.Issuer); profile == nil {
+			return nil, newVerificationError(ErrInvalidIssuer, "%q", unverified.Issuer)
+		}
+	}
+	return v.verify(ctx, tokenString, profile)
+}
+
+func (v *Verifier) verify(ctx context.Context, tokenString string, profile *Profile) (*Claims, error) {
+	claims := &Claims{cfg: v.cfg, profile: profile}
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		return tokenKey(ctx, token)
+	}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, keyFunc); err != nil {
+		return claims, verificationError(err)
+	}
+	return claims, nil
+}
+
+func (v *Verifier) profileForIssuer(iss string) *Profile {
+	for _, p := range v.profiles {
+		if p.hasIssuer(iss) {
+			return p
+		}
+	}
+	return nil
+}
+
+// VerifyRequest checks the validity and returns the claims of the token in
+// the request. If the Config has TokenSources, the token is taken from them
+// and verified like Verify does. Otherwise Profiles are tried in order, and
+// the token is verified with the first one whose TokenSource finds a token
+// in the request.
+// Claims may be returned even if an error occurs.
+func (v *Verifier) VerifyRequest(req *http.Request) (*Claims, error) {
+	if len(v.cfg.TokenSources) != 0 {
+		tokenString, err := tokenFromSources(req, v.cfg.TokenSources)
+		if err != nil {
+			return nil, err
+		}
+		return v.Verify(req.Context(), tokenString)
+	}
+	sources := make([]TokenSource, 0, len(v.profiles))
+	for _, p := range v.profiles {
+		if tokenString := p.TokenSource.Token(req); len(tokenString) != 0 {
+			return v.verify(req.Context(), tokenString, p)
+		}
+		sources = append(sources, p.TokenSource)
+	}
+	return nil, missingTokenError(sources)
+}
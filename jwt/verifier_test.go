@@ -0,0 +1,208 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+const testAudience = "/projects/1/global/backendServices/1"
+
+func newTestKey(t testing.TB) (*ecdsa.PrivateKey, PublicKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	b, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %+v", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})
+}
+
+func newTestConfig(t testing.TB, keys map[string]PublicKey) *Config {
+	t.Helper()
+	ks := NewKeyStore("", "")
+	ks.SetMany(keys)
+	return &Config{
+		PublicKeys:     ks,
+		MatchAudiences: regexp.MustCompile("^" + regexp.QuoteMeta(testAudience) + "$"),
+	}
+}
+
+func signTestToken(t testing.TB, claims jwt.Claims, kid string, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %+v", err)
+	}
+	return s
+}
+
+func TestVerifier(t *testing.T) {
+	key, pub := newTestKey(t)
+	cfg := newTestConfig(t, map[string]PublicKey{"key1": pub})
+	v := NewVerifier(cfg)
+
+	testCases := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{
+			name: "valid",
+			token: signTestToken(t, jwt.MapClaims{
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"iat":   time.Now().Unix(),
+				"aud":   testAudience,
+				"iss":   issuerClaim,
+				"email": "user@example.com",
+			}, "key1", key),
+		},
+		{
+			name:    "malformed",
+			token:   "invalid-token",
+			wantErr: ErrMalformedToken,
+		},
+		{
+			name: "expired",
+			token: signTestToken(t, jwt.MapClaims{
+				"exp": time.Now().Add(-time.Hour).Unix(),
+				"iat": time.Now().Add(-2 * time.Hour).Unix(),
+				"aud": testAudience,
+				"iss": issuerClaim,
+			}, "key1", key),
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name: "not valid yet",
+			token: signTestToken(t, jwt.MapClaims{
+				"exp": time.Now().Add(2 * time.Hour).Unix(),
+				"iat": time.Now().Add(time.Hour).Unix(),
+				"aud": testAudience,
+				"iss": issuerClaim,
+			}, "key1", key),
+			wantErr: ErrTokenNotValidYet,
+		},
+		{
+			name: "wrong issuer",
+			token: signTestToken(t, jwt.MapClaims{
+				"exp": time.Now().Add(time.Hour).Unix(),
+				"iat": time.Now().Unix(),
+				"aud": testAudience,
+				"iss": "https://cloud.google.com/not_iap",
+			}, "key1", key),
+			wantErr: ErrInvalidIssuer,
+		},
+		{
+			name: "wrong audience",
+			token: signTestToken(t, jwt.MapClaims{
+				"exp": time.Now().Add(time.Hour).Unix(),
+				"iat": time.Now().Unix(),
+				"aud": "/projects/2/global/backendServices/2",
+				"iss": issuerClaim,
+			}, "key1", key),
+			wantErr: ErrInvalidAudience,
+		},
+		{
+			name: "bad algorithm",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"aud": testAudience})
+				token.Header["kid"] = "key1"
+				s, err := token.SignedString([]byte("secret"))
+				if err != nil {
+					t.Fatalf("Failed to sign token: %+v", err)
+				}
+				return s
+			}(),
+			wantErr: ErrInvalidAlgorithm,
+		},
+		{
+			name: "unknown key",
+			token: signTestToken(t, jwt.MapClaims{
+				"exp": time.Now().Add(time.Hour).Unix(),
+				"iat": time.Now().Unix(),
+				"aud": testAudience,
+				"iss": issuerClaim,
+			}, "key2", key),
+			wantErr: ErrUnknownKeyID,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := v.Verify(context.Background(), tc.token)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("expected error %v, got %v", tc.wantErr, err)
+				}
+				var ve *VerificationError
+				if !errors.As(err, &ve) {
+					t.Errorf("expected *VerificationError, got %T", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("expected no error, got error:", err)
+			}
+			if claims.Email != "user@example.com" {
+				t.Errorf("unexpected email: %q", claims.Email)
+			}
+		})
+	}
+}
+
+// blockingKeySource blocks fetches until release is closed.
+type blockingKeySource struct {
+	release chan struct{}
+}
+
+func (s blockingKeySource) FetchKeys(ctx context.Context) (*KeySet, error) {
+	<-s.release
+	return &KeySet{Keys: map[string]PublicKey{}}, nil
+}
+
+func TestVerifierContext(t *testing.T) {
+	key, _ := newTestKey(t)
+	src := blockingKeySource{release: make(chan struct{})}
+	defer close(src.release)
+	cfg := newTestConfig(t, nil)
+	cfg.PublicKeys = NewKeyStoreWithSource(src)
+	token := signTestToken(t, jwt.MapClaims{
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+		"aud": testAudience,
+		"iss": issuerClaim,
+	}, "key1", key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewVerifier(cfg).Verify(ctx, token)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrUnknownKeyID) {
+			t.Errorf("expected ErrUnknownKeyID, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Verify did not return when its context was done")
+	}
+	if cfg.PublicKeys.isUnknown("key1") {
+		t.Error("key ID must not be remembered as unknown when the update was not waited for")
+	}
+}
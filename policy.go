@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"github.com/imkira/gcp-iap-auth/jwt"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// policy is a CEL expression that must evaluate to true for requests to be
+// allowed.
+type policy struct {
+	expr    string
+	program cel.Program
+}
+
+// policies is a list of policies that must all be satisfied.
+type policies []*policy
+
+// policyClaims holds the claims available to policies. The Google-specific
+// access levels are available as "access_levels", and the decoded JSON claims
+// as "raw".
+type policyClaims struct {
+	Subject       string           `cel:"sub"`
+	Email         string           `cel:"email"`
+	EmailVerified bool             `cel:"email_verified"`
+	HostedDomain  string           `cel:"hd"`
+	Issuer        string           `cel:"iss"`
+	Audience      string           `cel:"aud"`
+	IssuedAt      int64            `cel:"iat"`
+	ExpiresAt     int64            `cel:"exp"`
+	AccessLevels  []string         `cel:"access_levels"`
+	Raw           *structpb.Struct `cel:"raw"`
+}
+
+// policyRequest holds the attributes of the request available to policies.
+// Header names are lowercased, and only their first value is kept.
+type policyRequest struct {
+	Method  string            `cel:"method"`
+	Host    string            `cel:"host"`
+	Path    string            `cel:"path"`
+	Query   string            `cel:"query"`
+	Headers map[string]string `cel:"headers"`
+}
+
+// newPolicyEnv creates the CEL environment policies are compiled in.
+// The "claims" variable holds the verified claims, the "request" variable
+// holds attributes of the request and the "groups" variable holds the groups
+// of the user. Both claims and request have a fixed set of typed fields, so
+// that misspelled fields and type mismatches are caught at startup.
+func newPolicyEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		ext.NativeTypes(reflect.TypeOf(&policyClaims{}), reflect.TypeOf(&policyRequest{}), ext.ParseStructTags(true)),
+		cel.Variable("claims", cel.ObjectType(policyTypeName(policyClaims{}))),
+		cel.Variable("request", cel.ObjectType(policyTypeName(policyRequest{}))),
+		cel.Variable("groups", cel.ListType(cel.StringType)),
+	)
+}
+
+// policyTypeName returns the name of the CEL type of v, as declared by
+// ext.NativeTypes.
+func policyTypeName(v interface{}) string {
+	t := reflect.TypeOf(v)
+	return path.Base(t.PkgPath()) + "." + t.Name()
+}
+
+// compilePolicies compiles and type-checks the given CEL expressions.
+func compilePolicies(exprs []string) (policies, error) {
+	env, err := newPolicyEnv()
+	if err != nil {
+		return nil, err
+	}
+	var ps policies
+	for _, expr := range exprs {
+		ast, iss := env.Compile(expr)
+		if iss.Err() != nil {
+			return nil, fmt.Errorf("Invalid policy %q (%v)", expr, iss.Err())
+		}
+		if !ast.OutputType().IsExactType(cel.BoolType) && !ast.OutputType().IsExactType(cel.DynType) {
+			return nil, fmt.Errorf("Invalid policy %q (must evaluate to bool, not %v)", expr, ast.OutputType())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid policy %q (%v)", expr, err)
+		}
+		ps = append(ps, &policy{expr: expr, program: program})
+	}
+	return ps, nil
+}
+
+func (ps policies) authorize(req *http.Request, claims *jwt.Claims) (decision, error) {
+	vars := map[string]interface{}{
+		"claims":  newPolicyClaims(claims),
+		"request": newPolicyRequest(req),
+		"groups":  policyGroups(req),
+	}
+	for _, p := range ps {
+		out, _, err := p.program.ContextEval(req.Context(), vars)
+		if err != nil {
+			return decision{}, fmt.Errorf("%w: policy %q failed (%v)", errAccessDenied, p.expr, err)
+		}
+		if allowed, ok := out.Value().(bool); !ok || !allowed {
+			return decision{}, fmt.Errorf("%w: policy %q is not satisfied", errAccessDenied, p.expr)
+		}
+	}
+	return decision{reason: "policies are satisfied"}, nil
+}
+
+// newPolicyClaims returns the claims available to policies.
+func newPolicyClaims(claims *jwt.Claims) *policyClaims {
+	accessLevels := claims.AccessLevels()
+	if accessLevels == nil {
+		accessLevels = []string{}
+	}
+	raw, err := structpb.NewStruct(claims.Raw())
+	if err != nil {
+		// Claims decoded from JSON always convert.
+		raw = &structpb.Struct{}
+	}
+	return &policyClaims{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		HostedDomain:  claims.HostedDomain,
+		Issuer:        claims.Issuer,
+		Audience:      claims.Audience,
+		IssuedAt:      claims.IssuedAt,
+		ExpiresAt:     claims.ExpiresAt,
+		AccessLevels:  accessLevels,
+		Raw:           raw,
+	}
+}
+
+// newPolicyRequest returns the attributes of the request available to
+// policies.
+func newPolicyRequest(req *http.Request) *policyRequest {
+	headers := make(map[string]string, len(req.Header))
+	for name, values := range req.Header {
+		if len(values) != 0 {
+			headers[strings.ToLower(name)] = values[0]
+		}
+	}
+	return &policyRequest{
+		Method:  req.Method,
+		Host:    requestHost(req),
+		Path:    requestPath(req),
+		Query:   req.URL.RawQuery,
+		Headers: headers,
+	}
+}
+
+// policyGroups returns the groups of the user available to policies.
+func policyGroups(req *http.Request) []string {
+	if groups := groupsFromContext(req.Context()); groups != nil {
+		return groups
+	}
+	return []string{}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/tls"
 	"fmt"
-	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -14,11 +13,13 @@ import (
 type proxy struct {
 	backend     *url.URL
 	emailHeader string
+	access      *access
+	onError     jwt.ErrorHandler
 	proxy       *httputil.ReverseProxy
 	cfg         *jwt.Config
 }
 
-func newProxy(cfg *jwt.Config, backendURL, emailHeader string, backendInsecure bool) (*proxy, error) {
+func newProxy(cfg *jwt.Config, backendURL, emailHeader string, backendInsecure bool, acc *access, onError jwt.ErrorHandler) (*proxy, error) {
 	backend, err := url.Parse(backendURL)
 	if err != nil {
 		return nil, fmt.Errorf("Could not parse URL '%s': %s", backendURL, err)
@@ -35,23 +36,27 @@ func newProxy(cfg *jwt.Config, backendURL, emailHeader string, backendInsecure b
 	return &proxy{
 		backend:     backend,
 		emailHeader: emailHeader,
+		access:      acc,
+		onError:     onError,
 		proxy:       reverseProxy,
 		cfg:         cfg,
 	}, nil
 }
 
-func (p *proxy) handler(res http.ResponseWriter, req *http.Request) {
-	claims, err := jwt.RequestClaims(req, p.cfg)
+func (p *proxy) handler() http.Handler {
+	return jwt.Middleware(p.cfg, p.onError)(http.HandlerFunc(p.serve))
+}
+
+func (p *proxy) serve(res http.ResponseWriter, req *http.Request) {
+	claims, _ := jwt.ClaimsFromContext(req.Context())
+	header, err := p.access.check(req, claims)
 	if err != nil {
-		if claims == nil || len(claims.Email) == 0 {
-			log.Printf("Failed to authenticate (%v)\n", err)
-		} else {
-			log.Printf("Failed to authenticate %q (%v)\n", claims.Email, err)
-		}
-		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		p.onError(res, req, claims, err)
 		return
 	}
-
+	p.access.setIdentityHeaders(req.Header, claims)
+	p.access.setGroupsHeader(req.Header, claims)
+	p.access.setDecisionHeaders(req.Header, header)
 	if p.emailHeader != "" {
 		req.Header.Set(p.emailHeader, claims.Email)
 	}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/imkira/gcp-iap-auth/jwt"
+)
+
+// accessRule allows or denies the requests it matches. Requests match when
+// their host, path and method match any of the given ones (or there are
+// none), and the user matches any of the given emails, domains, email
+// patterns or groups (or there are none).
+type accessRule struct {
+	Name          string   `json:"name"`
+	Hosts         []string `json:"hosts"`
+	Paths         []string `json:"paths"`
+	Methods       []string `json:"methods"`
+	Emails        []string `json:"emails"`
+	Domains       []string `json:"domains"`
+	EmailPatterns []string `json:"emailPatterns"`
+	Groups        []string `json:"groups"`
+	Action        string   `json:"action"`
+
+	hosts     []*regexp.Regexp
+	paths     []*regexp.Regexp
+	allowlist *allowlist
+}
+
+// accessRules is an ordered list of rules. The first rule matching a
+// request decides whether it is allowed, and requests matching no rule are
+// denied.
+type accessRules []*accessRule
+
+// loadAccessRules loads rules from the JSON file at filePath.
+func loadAccessRules(filePath string) (accessRules, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read access rules %q (%v)", filePath, err)
+	}
+	defer f.Close()
+	var rules accessRules
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("Could not parse access rules %q (%v)", filePath, err)
+	}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("Invalid access rule %s (%v)", rule.Name, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *accessRule) compile() error {
+	if r.Action != "allow" && r.Action != "deny" {
+		return fmt.Errorf("action %q must be \"allow\" or \"deny\"", r.Action)
+	}
+	for _, host := range r.Hosts {
+		r.hosts = append(r.hosts, compileGlob(strings.ToLower(host), '.'))
+	}
+	for _, p := range r.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("path %q must start with \"/\"", p)
+		}
+		r.paths = append(r.paths, compilePathPattern(p))
+	}
+	for i, method := range r.Methods {
+		r.Methods[i] = strings.ToUpper(method)
+	}
+	allowlist, err := compileAllowlist(r.Emails, r.Domains, r.EmailPatterns)
+	if err != nil {
+		return err
+	}
+	r.allowlist = allowlist
+	return nil
+}
+
+// compilePathPattern compiles a path prefix, or a glob if it has wildcards.
+// Prefixes match whole segments: "/admin" and "/admin/" both match "/admin"
+// and "/admin/users", but not "/administrator". A glob ending with "/**"
+// also matches the path without it.
+func compilePathPattern(p string) *regexp.Regexp {
+	if !strings.Contains(p, "*") {
+		prefix := strings.TrimSuffix(p, "/")
+		return regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + "(?:/|$)")
+	}
+	if strings.HasSuffix(p, "/**") {
+		return regexp.MustCompile(fmt.Sprintf("^(?:%s|%s)$", globRegexp(p, '/'), globRegexp(strings.TrimSuffix(p, "/**"), '/')))
+	}
+	return compileGlob(p, '/')
+}
+
+// compileGlob compiles a glob where "*" matches any characters but sep,
+// and "**" matches any characters.
+func compileGlob(glob string, sep byte) *regexp.Regexp {
+	return regexp.MustCompile(fmt.Sprintf("^(?:%s)$", globRegexp(glob, sep)))
+}
+
+func globRegexp(glob string, sep byte) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			b.WriteString("[^" + regexp.QuoteMeta(string(sep)) + "]*")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+func (rules accessRules) authorize(req *http.Request, claims *jwt.Claims) (decision, error) {
+	host := requestHost(req)
+	p := requestPath(req)
+	for _, rule := range rules {
+		if !rule.matchesRequest(req.Method, host, p) {
+			continue
+		}
+		if !rule.matchesUser(req, claims) {
+			continue
+		}
+		if rule.Action == "deny" {
+			return decision{}, fmt.Errorf("%w: access rule %s denies %s %s%s", errAccessDenied, rule.Name, req.Method, host, p)
+		}
+		return decision{reason: fmt.Sprintf("access rule %s allows %s %s%s", rule.Name, req.Method, host, p)}, nil
+	}
+	return decision{}, fmt.Errorf("%w: no access rule allows %s %s%s", errAccessDenied, req.Method, host, p)
+}
+
+func (r *accessRule) matchesRequest(method, host, p string) bool {
+	return matchesAny(r.hosts, host) && matchesAny(r.paths, p) && (len(r.Methods) == 0 || contains(r.Methods, method))
+}
+
+func (r *accessRule) matchesUser(req *http.Request, claims *jwt.Claims) bool {
+	if r.allowlist == nil && len(r.Groups) == 0 {
+		return true
+	}
+	if r.allowlist != nil {
+		if _, err := r.allowlist.authorize(req, claims); err == nil {
+			return true
+		}
+	}
+	for _, group := range groupsFromContext(req.Context()) {
+		if contains(r.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	if len(res) == 0 {
+		return true
+	}
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHost returns the lowercased host of the request, without port.
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// requestPath returns the cleaned path of the request, so that paths such
+// as "/public/../admin" cannot bypass rules.
+func requestPath(req *http.Request) string {
+	p := req.URL.Path
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// originalHeaders names the headers in which a reverse proxy tells /auth the
+// URI, host and method of the request it asks to authorize. Only these are
+// read: the proxy must set them, overwriting any sent by clients. Requests
+// missing one are denied, rather than authorized as the /auth request itself.
+// Empty names leave the corresponding part of the /auth request as is.
+type originalHeaders struct {
+	uri    string
+	host   string
+	method string
+}
+
+// originalRequest returns the request that a reverse proxy asks /auth to
+// authorize, as told by the given headers.
+func originalRequest(req *http.Request, headers originalHeaders) (*http.Request, error) {
+	orig := new(http.Request)
+	*orig = *req
+	uri, err := originalHeader(req, headers.uri)
+	if err != nil {
+		return nil, err
+	}
+	if uri != "" {
+		u, err := url.ParseRequestURI(uri)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid original URI %q (%v)", errAccessDenied, uri, err)
+		}
+		orig.URL = u
+		orig.RequestURI = uri
+	}
+	host, err := originalHeader(req, headers.host)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		orig.Host = host
+	}
+	method, err := originalHeader(req, headers.method)
+	if err != nil {
+		return nil, err
+	}
+	if method != "" {
+		orig.Method = strings.ToUpper(method)
+	}
+	return orig, nil
+}
+
+func originalHeader(req *http.Request, name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	value := req.Header.Get(name)
+	if value == "" {
+		return "", fmt.Errorf("%w: missing %s header", errAccessDenied, name)
+	}
+	return value, nil
+}
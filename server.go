@@ -14,6 +14,8 @@ type server struct {
 	listener   net.Listener
 	listenAddr string
 	opts       *Options
+	cfg        *jwt.Config
+	access     *access
 }
 
 func NewServer() (*server, error) {
@@ -34,19 +36,26 @@ func NewServerWithArgs(args []string) (*server, error) {
 }
 
 func newServerByOpts(opts *Options, cfg *jwt.Config) (*server, error) {
-	log.Printf("Matching audiences: %s\n", cfg.MatchAudiences)
+	for _, profile := range cfg.Profiles {
+		log.Printf("Matching %s audiences: %s\n", profile.Name, profile.MatchAudiences)
+	}
 	mux := http.NewServeMux()
 
-	mux.Handle("/auth", authHandler(cfg))
-	mux.HandleFunc("/healthz", healthzHandler)
+	acc, err := newAccess(opts)
+	if err != nil {
+		return nil, err
+	}
+	onError := failureHandler(opts.JSONErrors)
+	mux.Handle("/auth", authHandler(cfg, acc, onError))
+	mux.HandleFunc("/healthz", healthzHandler(cfg))
 
 	if opts.Backend != "" {
-		proxy, err := newProxy(cfg, opts.Backend, opts.EmailHeader, opts.BackendInsecure)
+		proxy, err := newProxy(cfg, opts.Backend, opts.EmailHeader, opts.BackendInsecure, acc, onError)
 		if err != nil {
 			return nil, fmt.Errorf("prepare proxy handler : %w", err)
 		}
 		log.Printf("Proxying authenticated requests to backend %s", opts.Backend)
-		mux.HandleFunc("/", proxy.handler)
+		mux.Handle("/", proxy.handler())
 	}
 
 	addr := net.JoinHostPort(opts.ListenAddr, fmt.Sprintf("%d", opts.ListenPort))
@@ -63,6 +72,8 @@ func newServerByOpts(opts *Options, cfg *jwt.Config) (*server, error) {
 		listener:   listener,
 		listenAddr: listener.Addr().String(),
 		opts:       opts,
+		cfg:        cfg,
+		access:     acc,
 	}, nil
 }
 
@@ -90,6 +101,14 @@ func (s *server) listenAndServeHTTPS() error {
 }
 
 func (s *server) Close() error {
+	if err := s.access.Close(); err != nil {
+		return err
+	}
+	for _, profile := range s.cfg.Profiles {
+		if err := profile.PublicKeys.Close(); err != nil {
+			return err
+		}
+	}
 	return s.srv.Close()
 }
 
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imkira/gcp-iap-auth/jwt"
+)
+
+// maxWebhookCacheEntries bounds the number of cached webhook decisions.
+const maxWebhookCacheEntries = 10000
+
+// errWebhookUnavailable is wrapped by the errors of webhook requests that got
+// no answer: transport errors, timeouts and 5xx replies. Only these may fail
+// open; any other reply that does not allow the request denies it.
+var errWebhookUnavailable = errors.New("webhook unavailable")
+
+// webhookRequest is the body POSTed to the authorization webhook.
+type webhookRequest struct {
+	Subject      string   `json:"sub"`
+	Email        string   `json:"email"`
+	HostedDomain string   `json:"hd,omitempty"`
+	Audience     string   `json:"audience"`
+	Groups       []string `json:"groups,omitempty"`
+	Method       string   `json:"method"`
+	Host         string   `json:"host"`
+	Path         string   `json:"path"`
+}
+
+// webhookResponse is the body the authorization webhook answers with.
+type webhookResponse struct {
+	Allow   bool              `json:"allow"`
+	Reason  string            `json:"reason"`
+	Headers map[string]string `json:"headers"`
+}
+
+type webhookCacheEntry struct {
+	resp    *webhookResponse
+	expires time.Time
+}
+
+// webhook asks an external service whether requests are allowed.
+type webhook struct {
+	url       string
+	client    *http.Client
+	timeout   time.Duration
+	failOpen  bool
+	cacheTTL  time.Duration
+	cacheLock sync.Mutex
+	cache     map[webhookRequestKey]webhookCacheEntry
+	// headers are the canonical names of the headers the webhook may set.
+	headers []string
+}
+
+// webhookRequestKey identifies the user, audience and route of a webhook
+// request. groups holds the sorted groups of the user, one per line, so that
+// decisions are not reused once they change.
+type webhookRequestKey struct {
+	subject, email, audience, groups, method, host, path string
+}
+
+func newWebhook(opts *Options) (*webhook, error) {
+	u, err := url.Parse(opts.WebhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid authorization webhook URL %q (%v)", opts.WebhookURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid authorization webhook URL %q (must be an absolute http or https URL)", opts.WebhookURL)
+	}
+	if opts.WebhookTimeout <= 0 {
+		return nil, fmt.Errorf("Invalid authorization webhook timeout %v (must be positive)", opts.WebhookTimeout)
+	}
+	headers, _ := loadList(opts.WebhookHeaders, "")
+	for i, name := range headers {
+		headers[i] = http.CanonicalHeaderKey(name)
+	}
+	return &webhook{
+		url:      opts.WebhookURL,
+		client:   &http.Client{},
+		timeout:  opts.WebhookTimeout,
+		failOpen: opts.WebhookFailure == "open",
+		cacheTTL: opts.WebhookCacheTTL,
+		cache:    make(map[webhookRequestKey]webhookCacheEntry),
+		headers:  headers,
+	}, nil
+}
+
+func (w *webhook) authorize(req *http.Request, claims *jwt.Claims) (decision, error) {
+	body := &webhookRequest{
+		Subject:      claims.Subject,
+		Email:        claims.Email,
+		HostedDomain: claims.HostedDomain,
+		Audience:     claims.Audience,
+		Groups:       groupsFromContext(req.Context()),
+		Method:       req.Method,
+		Host:         requestHost(req),
+		Path:         requestPath(req),
+	}
+	key := webhookRequestKey{body.Subject, body.Email, body.Audience, strings.Join(body.Groups, "\n"), body.Method, body.Host, body.Path}
+	resp, cached := w.cached(key)
+	if !cached {
+		var err error
+		if resp, err = w.post(req.Context(), body); err != nil {
+			if w.failOpen && errors.Is(err, errWebhookUnavailable) {
+				log.Printf("WARNING: authorization webhook failed, allowing %q (%v)\n", claims.Email, err)
+				return decision{reason: "authorization webhook failed open"}, nil
+			}
+			return decision{}, fmt.Errorf("%w: authorization webhook failed (%v)", errAccessDenied, err)
+		}
+		w.store(key, resp)
+	}
+	if !resp.Allow {
+		return decision{}, fmt.Errorf("%w: authorization webhook denies %s %s%s (%s)", errAccessDenied, body.Method, body.Host, body.Path, resp.Reason)
+	}
+	d := decision{reason: fmt.Sprintf("authorization webhook allows %s %s%s", body.Method, body.Host, body.Path)}
+	if resp.Reason != "" {
+		d.reason += fmt.Sprintf(" (%s)", resp.Reason)
+	}
+	if len(resp.Headers) != 0 {
+		d.header = make(http.Header, len(resp.Headers))
+		for name, value := range resp.Headers {
+			if !contains(w.headers, http.CanonicalHeaderKey(name)) {
+				log.Printf("WARNING: ignoring header %q set by the authorization webhook (not in --authz-webhook-headers)\n", name)
+				continue
+			}
+			d.header.Set(name, value)
+		}
+	}
+	return d, nil
+}
+
+// post POSTs body to the webhook and decodes its response.
+func (w *webhook) post(ctx context.Context, body *webhookRequest) (*webhookResponse, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := w.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errWebhookUnavailable, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("%w: unexpected status %q", errWebhookUnavailable, res.Status)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", res.Status)
+	}
+	resp := &webhookResponse{}
+	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+		return nil, fmt.Errorf("could not decode response (%v)", err)
+	}
+	return resp, nil
+}
+
+// cached returns the cached response for key, if any.
+func (w *webhook) cached(key webhookRequestKey) (*webhookResponse, bool) {
+	if w.cacheTTL <= 0 {
+		return nil, false
+	}
+	w.cacheLock.Lock()
+	defer w.cacheLock.Unlock()
+	entry, ok := w.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(w.cache, key)
+		return nil, false
+	}
+	return entry.resp, true
+}
+
+// store caches resp for key. Once maxWebhookCacheEntries are cached, the
+// entry expiring first is dropped: as all entries have the same TTL, it is
+// the oldest, and any expired entry goes before fresh ones.
+func (w *webhook) store(key webhookRequestKey, resp *webhookResponse) {
+	if w.cacheTTL <= 0 {
+		return
+	}
+	w.cacheLock.Lock()
+	defer w.cacheLock.Unlock()
+	if _, ok := w.cache[key]; !ok && len(w.cache) >= maxWebhookCacheEntries {
+		var oldest webhookRequestKey
+		var oldestExpires time.Time
+		for k, entry := range w.cache {
+			if oldestExpires.IsZero() || entry.expires.Before(oldestExpires) {
+				oldest, oldestExpires = k, entry.expires
+			}
+		}
+		delete(w.cache, oldest)
+	}
+	w.cache[key] = webhookCacheEntry{resp: resp, expires: time.Now().Add(w.cacheTTL)}
+}